@@ -2,34 +2,67 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	_ "github.com/mattn/go-sqlite3"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 
+	"github.com/mrdjeb/trueproxy/internal/api/handlers/intercept/pending"
+	"github.com/mrdjeb/trueproxy/internal/api/handlers/intercept/resolve"
+	"github.com/mrdjeb/trueproxy/internal/api/handlers/intercept/rules"
+	"github.com/mrdjeb/trueproxy/internal/api/handlers/request/frames"
 	"github.com/mrdjeb/trueproxy/internal/api/handlers/request/list"
 	"github.com/mrdjeb/trueproxy/internal/api/handlers/request/one"
+	"github.com/mrdjeb/trueproxy/internal/api/handlers/request/remove"
 	"github.com/mrdjeb/trueproxy/internal/api/handlers/request/repeat"
 	"github.com/mrdjeb/trueproxy/internal/api/handlers/request/scan"
+	"github.com/mrdjeb/trueproxy/internal/api/handlers/request/search"
+	rewriterules "github.com/mrdjeb/trueproxy/internal/api/handlers/rewrite/rules"
+	scoperules "github.com/mrdjeb/trueproxy/internal/api/handlers/scope/rules"
+	storagestats "github.com/mrdjeb/trueproxy/internal/api/handlers/storage/stats"
+	tunnels "github.com/mrdjeb/trueproxy/internal/api/handlers/tunnel/list"
+	"github.com/mrdjeb/trueproxy/internal/ca"
 	"github.com/mrdjeb/trueproxy/internal/config"
+	"github.com/mrdjeb/trueproxy/internal/intercept"
 	"github.com/mrdjeb/trueproxy/internal/logger"
 	"github.com/mrdjeb/trueproxy/internal/logger/sl"
 	"github.com/mrdjeb/trueproxy/internal/models"
 	"github.com/mrdjeb/trueproxy/internal/proxy"
+	"github.com/mrdjeb/trueproxy/internal/retention"
+	"github.com/mrdjeb/trueproxy/internal/rewrite"
+	"github.com/mrdjeb/trueproxy/internal/scope"
 	"github.com/mrdjeb/trueproxy/internal/storage"
+	"github.com/mrdjeb/trueproxy/internal/writequeue"
 )
 
 func main() {
 	cfg := config.MustLoad()
 
+	if args := flag.Args(); len(args) > 0 {
+		if args[0] != "ca" {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+			os.Exit(2)
+		}
+		if err := ca.Run(cfg.Cert, args[1:], os.Stdout, os.Stderr); err != nil {
+			if !errors.Is(err, flag.ErrHelp) {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
 	log := logger.Set(cfg.LogEnviroment)
 
 	log.Info(
@@ -37,38 +70,111 @@ func main() {
 		slog.String("env", cfg.LogEnviroment),
 		slog.String("proxy-addr", cfg.ProxyServer.Address),
 		slog.String("api-addr", cfg.ApiServer.Address),
+		slog.String("socks-addr", cfg.SocksServer.Address),
+		slog.String("transparent-addr", cfg.TransparentServer.Address),
+		slog.String("upstream", cfg.ProxyServer.Upstream.URL),
+		slog.String("reverse", cfg.ProxyServer.Reverse),
 	)
 	log.Debug("debug messages are enabled")
 
-	db, err := gorm.Open(sqlite.Open("./stage.db"), &gorm.Config{})
+	// Times are stored in UTC so their text orders by instant.
+	db, err := gorm.Open(sqlite.Open("./stage.db"), &gorm.Config{
+		NowFunc: func() time.Time { return time.Now().UTC() },
+	})
 	if err != nil {
 		log.Error("Error connect to storage", sl.Err(err))
 		os.Exit(1)
 	}
-	db.AutoMigrate(&models.RequestResponse{})
+	migrated, err := storage.EnableIncrementalVacuum(db)
+	if err != nil {
+		log.Error("Failed enable incremental vacuum", sl.Err(err))
+		os.Exit(1)
+	}
+	if migrated {
+		log.Info("storage rebuilt with incremental vacuum")
+	}
+	db.AutoMigrate(&models.RequestResponse{}, &models.WebSocketFrame{}, &models.RewriteRule{}, &models.ScopeRule{}, &models.Tunnel{})
+	if err := storage.UTCCreatedAt(db); err != nil {
+		log.Error("Failed store request times in UTC", sl.Err(err))
+		os.Exit(1)
+	}
 
 	repoRequest := storage.NewRequestsRepo(db)
+	writer := writequeue.New(log, cfg.WriteQueue)
+
+	// Background workers run until stopWorkers is closed.
+	stopWorkers := make(chan struct{})
+
+	retentionWorker := retention.New(log, repoRequest, cfg.Retention)
+	if retentionWorker.Enabled() {
+		go retentionWorker.Run(stopWorkers)
+	}
+
+	rewriter, err := rewrite.New(log, storage.NewRewriteRepo(db))
+	if err != nil {
+		log.Error("Failed load rewrite rules", sl.Err(err))
+		os.Exit(1)
+	}
+
+	projectScope, err := scope.New(log, storage.NewScopeRepo(db), cfg.ProxyServer.OutOfScope)
+	if err != nil {
+		log.Error("Failed load scope", sl.Err(err))
+		os.Exit(1)
+	}
+	go projectScope.Run(stopWorkers)
+
+	if !ca.Exists(cfg.Cert) {
+		if err := ca.Init(cfg.Cert, ca.DefaultOptions(cfg.Cert), false); err != nil {
+			log.Error("Failed generate CA", sl.Err(err))
+			os.Exit(1)
+		}
+		log.Warn("generated new CA, install it on clients",
+			slog.String("cert", cfg.Cert.CACertFile),
+		)
+	}
 
-	cm, err := proxy.NewCertManager(cfg.Cert)
+	transport, err := proxy.NewTransport(cfg.ProxyServer.Upstream)
+	if err != nil {
+		log.Error("Failed init upstream transport", sl.Err(err))
+		os.Exit(1)
+	}
+
+	cm, err := proxy.NewCertManager(cfg.Cert, transport)
 	if err != nil {
 		log.Error("Failed init cert manager", sl.Err(err))
 		os.Exit(1)
 	}
 
-	rt := proxy.NewProxyRoundTripper(log, repoRequest)
+	queue := intercept.New(cfg.ProxyServer.InterceptTimeout)
+
+	rt := proxy.NewProxyRoundTripper(log, cfg.ProxyServer, repoRequest, writer, transport, queue, rewriter, projectScope)
+
+	proxyHandler := proxy.NewProxy(
+		log,
+		cfg.ProxyServer,
+		cm,
+		repoRequest,
+		writer,
+		rt,
+		transport,
+		projectScope)
+
+	var handler http.Handler = proxyHandler
+	if cfg.ProxyServer.Reverse != "" {
+		handler, err = proxy.NewReverse(proxyHandler, cfg.ProxyServer.Reverse)
+		if err != nil {
+			log.Error("Failed init reverse proxy", sl.Err(err))
+			os.Exit(1)
+		}
+	}
 
 	srvProxy := &http.Server{
-		Handler: proxy.NewProxy(
-			log,
-			cm,
-			repoRequest,
-			rt),
+		Handler:           handler,
 		Addr:              cfg.ProxyServer.Address,
 		ReadTimeout:       cfg.ProxyServer.ReadTimeout,
 		WriteTimeout:      cfg.ProxyServer.WriteTimeout,
 		IdleTimeout:       cfg.ProxyServer.IdleTimeout,
 		ReadHeaderTimeout: cfg.ProxyServer.ReadHeaderTimeout,
-		TLSNextProto:      make(map[string]func(*http.Server, *tls.Conn, http.Handler)), //disable http2
 	}
 
 	srvApi := &http.Server{
@@ -90,10 +196,34 @@ func main() {
 		return c.String(http.StatusOK, "You <----> TrueProxy <----> Wild Network")
 	})
 
-	e.GET("/requests", list.New(log, repoRequest))         // – список запросов
-	e.GET("/request/:id", one.New(log, repoRequest))       // – вывод 1 запроса
-	e.GET("/repeat/:id", repeat.New(log, repoRequest, rt)) // – повторная отправка запроса
-	e.GET("/scan/:id", scan.New(log, repoRequest))         // – сканирование запроса
+	e.GET("/requests", list.New(log, repoRequest))             // – список запросов
+	e.DELETE("/requests", remove.NewBulk(log, repoRequest))    // – удаление запросов по фильтру, all=true – всех
+	e.GET("/request/:id", one.New(log, repoRequest))           // – вывод 1 запроса
+	e.DELETE("/request/:id", remove.NewOne(log, repoRequest))  // – удаление 1 запроса
+	e.GET("/request/:id/frames", frames.New(log, repoRequest)) // – фреймы WebSocket соединения
+	e.GET("/repeat/:id", repeat.New(log, repoRequest, rt))     // – повторная отправка запроса
+	e.GET("/scan/:id", scan.New(log, repoRequest, transport))  // – сканирование запроса
+	e.GET("/tunnels", tunnels.New(log, repoRequest))           // – соединения без расшифровки
+	e.GET("/search", search.New(log, repoRequest))             // – полнотекстовый поиск по заголовкам и телам
+
+	e.GET("/storage/stats", storagestats.New(log, writer)) // – очередь записи: размер, повторы, потерянные записи
+
+	e.GET("/intercept", pending.New(log, queue))                                       // – задержанные запросы и ответы
+	e.POST("/intercept/:id/forward", resolve.New(log, queue, intercept.ActionForward)) // – отправить дальше, тело – изменённый raw
+	e.POST("/intercept/:id/drop", resolve.New(log, queue, intercept.ActionDrop))       // – отбросить
+	e.GET("/intercept/rules", rules.NewList(log, queue))                               // – правила перехвата
+	e.POST("/intercept/rules", rules.NewCreate(log, queue))                            // – добавить правило
+	e.DELETE("/intercept/rules/:id", rules.NewDelete(log, queue))                      // – удалить правило
+
+	e.GET("/rewrite/rules", rewriterules.NewList(log, rewriter))          // – правила замены
+	e.POST("/rewrite/rules", rewriterules.NewCreate(log, rewriter))       // – добавить правило
+	e.PUT("/rewrite/rules/:id", rewriterules.NewUpdate(log, rewriter))    // – изменить правило
+	e.DELETE("/rewrite/rules/:id", rewriterules.NewDelete(log, rewriter)) // – удалить правило
+
+	e.GET("/scope/rules", scoperules.NewList(log, projectScope))          // – правила scope
+	e.POST("/scope/rules", scoperules.NewCreate(log, projectScope))       // – добавить правило
+	e.PUT("/scope/rules/:id", scoperules.NewUpdate(log, projectScope))    // – изменить правило
+	e.DELETE("/scope/rules/:id", scoperules.NewDelete(log, projectScope)) // – удалить правило
 
 	//- - - - - - - Echo for API - - - - - - -//
 
@@ -102,12 +232,47 @@ func main() {
 
 	go func() {
 		// EXPOSE PORT 62801
-		if err := srvProxy.ListenAndServe(); err != nil &&
+		var err error
+		if cfg.ProxyServer.Reverse != "" && cfg.ProxyServer.ReverseTLS {
+			srvProxy.TLSConfig = cm.NewTLSConfig("localhost")
+			err = srvProxy.ListenAndServeTLS("", "")
+		} else {
+			err = srvProxy.ListenAndServe()
+		}
+		if err != nil &&
 			!errors.Is(err, http.ErrServerClosed) {
 			log.Error("proxy server returned err: ", sl.Err(err))
 		}
 	}()
 
+	var socksListener net.Listener
+	if cfg.SocksServer.Address != "" {
+		socksListener, err = net.Listen("tcp", cfg.SocksServer.Address)
+		if err != nil {
+			log.Error("Failed listen socks address", sl.Err(err))
+			os.Exit(1)
+		}
+		go func() {
+			if err := proxyHandler.ServeSOCKS(socksListener); err != nil {
+				log.Error("socks server returned err: ", sl.Err(err))
+			}
+		}()
+	}
+
+	var transparentListener net.Listener
+	if cfg.TransparentServer.Address != "" {
+		transparentListener, err = proxy.ListenTransparent(cfg.TransparentServer.Address)
+		if err != nil {
+			log.Error("Failed listen transparent address", sl.Err(err))
+			os.Exit(1)
+		}
+		go func() {
+			if err := proxyHandler.ServeTransparent(transparentListener); err != nil {
+				log.Error("transparent server returned err: ", sl.Err(err))
+			}
+		}()
+	}
+
 	go func() {
 		// EXPOSE PORT 62802
 		err := e.Start(cfg.ApiServer.Address)
@@ -128,9 +293,24 @@ func main() {
 	if err := srvProxy.Shutdown(ctx); err != nil {
 		log.Error("server shutdown returned an err: ", sl.Err(err))
 	}
+	if socksListener != nil {
+		if err := socksListener.Close(); err != nil {
+			log.Error("socks listener close returned an err: ", sl.Err(err))
+		}
+	}
+	if transparentListener != nil {
+		if err := transparentListener.Close(); err != nil {
+			log.Error("transparent listener close returned an err: ", sl.Err(err))
+		}
+	}
 	if err := srvApi.Shutdown(ctx); err != nil {
 		log.Error("server shutdown returned an err: ", sl.Err(err))
 	}
+	// Captured traffic still queued is written before exit.
+	if err := writer.Close(ctx); err != nil {
+		log.Error("write queue close returned an err: ", sl.Err(err))
+	}
+	close(stopWorkers)
 
 	log.Debug("server stopped")
 
@@ -0,0 +1,29 @@
+package pending
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrdjeb/trueproxy/internal/intercept"
+)
+
+type PendingGetter interface {
+	Pending() []intercept.Item
+}
+
+func New(log *slog.Logger, pendingGetter PendingGetter) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		const op = "api.intercept.pending.New"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", c.Request().Header.Get(echo.HeaderXRequestID)),
+		)
+
+		items := pendingGetter.Pending()
+		log.Debug("pending intercepted items", slog.Int("count", len(items)))
+
+		return c.JSON(http.StatusOK, items)
+	}
+}
@@ -0,0 +1,57 @@
+package resolve
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	resp "github.com/mrdjeb/trueproxy/internal/api/response"
+	"github.com/mrdjeb/trueproxy/internal/intercept"
+	"github.com/mrdjeb/trueproxy/internal/logger/sl"
+)
+
+type Resolver interface {
+	Resolve(string, intercept.Decision) error
+}
+
+// New resolves a held item with the action from the path. Request body,
+// when not empty, replaces the raw request or response being forwarded.
+func New(log *slog.Logger, resolver Resolver, action string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		const op = "api.intercept.resolve.New"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", c.Request().Header.Get(echo.HeaderXRequestID)),
+		)
+
+		raw, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			log.Error("failed to read body", sl.Err(err))
+
+			c.JSON(http.StatusBadRequest, resp.Err("bad body"))
+			return err
+		}
+
+		err = resolver.Resolve(c.Param("id"), intercept.Decision{
+			Action: action,
+			Raw:    string(raw),
+		})
+		if err != nil {
+			if errors.Is(err, intercept.ErrItemNotFound) {
+				log.Warn("intercepted item not found", sl.Err(err))
+
+				c.JSON(http.StatusNotFound, resp.Err(err.Error()))
+				return err
+			}
+			log.Error("failed to resolve", sl.Err(err))
+
+			c.JSON(http.StatusBadRequest, resp.Err(err.Error()))
+			return err
+		}
+
+		return c.JSON(http.StatusOK, resp.OK())
+	}
+}
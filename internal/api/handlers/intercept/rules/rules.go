@@ -0,0 +1,100 @@
+package rules
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	resp "github.com/mrdjeb/trueproxy/internal/api/response"
+	"github.com/mrdjeb/trueproxy/internal/intercept"
+	"github.com/mrdjeb/trueproxy/internal/logger/sl"
+)
+
+type RulesManager interface {
+	Rules() []intercept.Rule
+	AddRule(intercept.Rule) (intercept.Rule, error)
+	DeleteRule(uint) error
+}
+
+func NewList(log *slog.Logger, manager RulesManager) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		const op = "api.intercept.rules.NewList"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", c.Request().Header.Get(echo.HeaderXRequestID)),
+		)
+
+		rules := manager.Rules()
+		log.Debug("intercept rules", slog.Int("count", len(rules)))
+
+		if err := c.JSON(http.StatusOK, rules); err != nil {
+			log.Error("failed to write rules", sl.Err(err))
+			return err
+		}
+		return nil
+	}
+}
+
+func NewCreate(log *slog.Logger, manager RulesManager) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		const op = "api.intercept.rules.NewCreate"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", c.Request().Header.Get(echo.HeaderXRequestID)),
+		)
+
+		var rule intercept.Rule
+		if err := c.Bind(&rule); err != nil {
+			log.Error("failed to bind rule", sl.Err(err))
+
+			c.JSON(http.StatusBadRequest, resp.Err("bad rule"))
+			return err
+		}
+
+		rule, err := manager.AddRule(rule)
+		if err != nil {
+			log.Warn("failed to add rule", sl.Err(err))
+
+			c.JSON(http.StatusBadRequest, resp.Err(err.Error()))
+			return err
+		}
+
+		return c.JSON(http.StatusCreated, rule)
+	}
+}
+
+func NewDelete(log *slog.Logger, manager RulesManager) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		const op = "api.intercept.rules.NewDelete"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", c.Request().Header.Get(echo.HeaderXRequestID)),
+		)
+
+		id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			log.Error("failed to ParseUint ID", sl.Err(err))
+
+			c.JSON(http.StatusBadRequest, resp.Err("bad id"))
+			return err
+		}
+
+		if err := manager.DeleteRule(uint(id)); err != nil {
+			if errors.Is(err, intercept.ErrRuleNotFound) {
+				c.JSON(http.StatusNotFound, resp.Err(err.Error()))
+				return err
+			}
+			log.Error("failed to delete rule", sl.Err(err))
+
+			c.JSON(http.StatusInternalServerError, resp.Err("internal error"))
+			return err
+		}
+
+		return c.JSON(http.StatusOK, resp.OK())
+	}
+}
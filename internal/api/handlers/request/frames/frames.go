@@ -0,0 +1,45 @@
+package frames
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	resp "github.com/mrdjeb/trueproxy/internal/api/response"
+	"github.com/mrdjeb/trueproxy/internal/logger/sl"
+	"github.com/mrdjeb/trueproxy/internal/models"
+)
+
+type FramesGetter interface {
+	ReadFrames(uint) ([]models.WebSocketFrame, error)
+}
+
+func New(log *slog.Logger, framesGetter FramesGetter) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		const op = "api.request.frames.New"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", c.Request().Header.Get(echo.HeaderXRequestID)),
+		)
+
+		id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			log.Error("failed to ParseUint ID", sl.Err(err))
+
+			c.JSON(http.StatusBadRequest, resp.Err("bad id"))
+			return err
+		}
+
+		frames, err := framesGetter.ReadFrames(uint(id))
+		if err != nil {
+			log.Error("failed to framesGetter", sl.Err(err))
+
+			c.JSON(http.StatusInternalServerError, resp.Err("internal error"))
+			return err
+		}
+
+		return c.JSON(http.StatusOK, frames)
+	}
+}
@@ -2,8 +2,12 @@ package list
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	resp "github.com/mrdjeb/trueproxy/internal/api/response"
@@ -12,14 +16,11 @@ import (
 	"github.com/mrdjeb/trueproxy/internal/storage"
 )
 
-/*type RequestsRepo interface {
-	CreateRequest(*models.DumpRequest) error
-	ReadRequest(id int) (models.DumpRequest, error)
-	ReadAllRequest() ([]models.DumpRequest, error)
-}*/
+// HeaderNextCursor holds the cursor of the next page, absent on the last one.
+const HeaderNextCursor = "X-Next-Cursor"
 
 type RequestListGetter interface {
-	ReadAllRequest() ([]models.RequestResponse, error)
+	ListRequests(storage.RequestFilter) ([]models.RequestSummary, error)
 }
 
 func New(log *slog.Logger, requestListGetter RequestListGetter) echo.HandlerFunc {
@@ -31,10 +32,18 @@ func New(log *slog.Logger, requestListGetter RequestListGetter) echo.HandlerFunc
 			slog.String("request_id", c.Request().Header.Get(echo.HeaderXRequestID)),
 		)
 
-		requests, err := requestListGetter.ReadAllRequest()
+		filter, err := BindFilter(c)
 		if err != nil {
-			if errors.Is(err, storage.ErrRequestNotFound) {
-				log.Warn("request not found", sl.Err(err))
+			log.Error("failed to bind filter", sl.Err(err))
+
+			c.JSON(http.StatusBadRequest, resp.Err("bad filter"))
+			return err
+		}
+
+		requests, err := requestListGetter.ListRequests(filter)
+		if err != nil {
+			if errors.Is(err, storage.ErrBadFilter) {
+				log.Warn("bad filter", sl.Err(err))
 
 				c.JSON(http.StatusBadRequest, resp.Err(err.Error()))
 				return err
@@ -45,8 +54,79 @@ func New(log *slog.Logger, requestListGetter RequestListGetter) echo.HandlerFunc
 			return err
 		}
 
-		//log.Debug("Get this to render worker", (*workers))
+		if cursor, ok := nextCursor(filter, requests); ok {
+			c.Response().Header().Set(HeaderNextCursor, strconv.FormatUint(uint64(cursor), 10))
+		}
 
 		return c.JSON(http.StatusOK, requests)
 	}
 }
+
+// BindFilter reads a RequestFilter from query parameters.
+func BindFilter(c echo.Context) (storage.RequestFilter, error) {
+	var filter storage.RequestFilter
+	var status string
+	err := echo.QueryParamsBinder(c).
+		Bool("in_scope", &filter.InScope).
+		String("sni", &filter.SNI).
+		String("ja3", &filter.JA3).
+		String("ja4", &filter.JA4).
+		String("host", &filter.Host).
+		String("method", &filter.Method).
+		String("status", &status).
+		String("path", &filter.Path).
+		Time("since", &filter.Since, time.RFC3339).
+		Time("until", &filter.Until, time.RFC3339).
+		String("content_type", &filter.ContentType).
+		String("q", &filter.Query).
+		String("sort", &filter.Sort).
+		Int("limit", &filter.Limit).
+		Int("offset", &filter.Offset).
+		Uint("cursor", &filter.Cursor).
+		BindError()
+	if err != nil {
+		return storage.RequestFilter{}, err
+	}
+	filter.StatusMin, filter.StatusMax, err = parseStatus(status)
+	if err != nil {
+		return storage.RequestFilter{}, err
+	}
+	filter.Since, filter.Until = filter.Since.UTC(), filter.Until.UTC()
+	return filter, nil
+}
+
+// parseStatus reads an exact status code like "404" or a class like "5xx".
+func parseStatus(s string) (int, int, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	if len(s) == 3 && strings.HasSuffix(strings.ToLower(s), "xx") && s[0] >= '1' && s[0] <= '5' {
+		class := int(s[0]-'0') * 100
+		return class, class + 99, nil
+	}
+	code, err := strconv.Atoi(s)
+	if err != nil || code < 100 || code > 999 {
+		return 0, 0, fmt.Errorf("bad status %q", s)
+	}
+	return code, code, nil
+}
+
+// nextCursor is the id the next page starts after, if the page is full and
+// sorted by id.
+func nextCursor(filter storage.RequestFilter, page []models.RequestSummary) (uint, bool) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = storage.DefaultPageSize
+	}
+	limit = min(limit, storage.MaxPageSize)
+
+	switch strings.TrimPrefix(filter.Sort, "-") {
+	case "", "id", "time":
+	default:
+		return 0, false
+	}
+	if len(page) == 0 || len(page) < limit {
+		return 0, false
+	}
+	return page[len(page)-1].ID, true
+}
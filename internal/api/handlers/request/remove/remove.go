@@ -0,0 +1,123 @@
+package remove
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrdjeb/trueproxy/internal/api/handlers/request/list"
+	resp "github.com/mrdjeb/trueproxy/internal/api/response"
+	"github.com/mrdjeb/trueproxy/internal/logger/sl"
+	"github.com/mrdjeb/trueproxy/internal/storage"
+)
+
+type RequestDeleter interface {
+	DeleteRequest(uint) error
+	Vacuum() error
+}
+
+type RequestsDeleter interface {
+	DeleteRequests(storage.RequestFilter) (int64, error)
+	Vacuum() error
+}
+
+type BulkResponse struct {
+	resp.Response
+	Deleted int64 `json:"deleted"`
+}
+
+func NewOne(log *slog.Logger, requestDeleter RequestDeleter) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		const op = "api.request.remove.NewOne"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", c.Request().Header.Get(echo.HeaderXRequestID)),
+		)
+
+		id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			log.Error("failed to ParseUint ID", sl.Err(err))
+
+			c.JSON(http.StatusBadRequest, resp.Err("bad id"))
+			return err
+		}
+
+		if err := requestDeleter.DeleteRequest(uint(id)); err != nil {
+			if errors.Is(err, storage.ErrRequestNotFound) {
+				c.JSON(http.StatusNotFound, resp.Err(err.Error()))
+				return err
+			}
+			log.Error("failed to delete request", sl.Err(err))
+
+			c.JSON(http.StatusInternalServerError, resp.Err("internal error"))
+			return err
+		}
+
+		// The request is gone either way, space is reclaimed later.
+		if err := requestDeleter.Vacuum(); err != nil {
+			log.Warn("failed to vacuum storage", sl.Err(err))
+		}
+
+		return c.JSON(http.StatusOK, resp.OK())
+	}
+}
+
+// NewBulk deletes requests matching the list filter. A request without
+// filter parameters is refused unless all=true is set.
+func NewBulk(log *slog.Logger, requestsDeleter RequestsDeleter) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		const op = "api.request.remove.NewBulk"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", c.Request().Header.Get(echo.HeaderXRequestID)),
+		)
+
+		filter, err := list.BindFilter(c)
+		var all bool
+		if err == nil {
+			err = echo.QueryParamsBinder(c).Bool("all", &all).BindError()
+		}
+		if err != nil {
+			log.Error("failed to bind filter", sl.Err(err))
+
+			c.JSON(http.StatusBadRequest, resp.Err("bad filter"))
+			return err
+		}
+
+		// Paging does not narrow a delete.
+		filter.Sort, filter.Limit, filter.Offset, filter.Cursor = "", 0, 0, 0
+		if filter == (storage.RequestFilter{}) && !all {
+			err := errors.New("empty filter")
+			log.Warn("refused to delete all requests", sl.Err(err))
+
+			c.JSON(http.StatusBadRequest, resp.Err("empty filter, set all=true to delete every request"))
+			return err
+		}
+
+		deleted, err := requestsDeleter.DeleteRequests(filter)
+		if err != nil {
+			if errors.Is(err, storage.ErrBadFilter) {
+				log.Warn("bad filter", sl.Err(err))
+
+				c.JSON(http.StatusBadRequest, resp.Err(err.Error()))
+				return err
+			}
+			log.Error("failed to delete requests", sl.Err(err))
+
+			c.JSON(http.StatusInternalServerError, resp.Err("internal error"))
+			return err
+		}
+
+		log.Info("requests deleted", slog.Int64("count", deleted))
+
+		if err := requestsDeleter.Vacuum(); err != nil {
+			log.Warn("failed to vacuum storage", sl.Err(err))
+		}
+
+		return c.JSON(http.StatusOK, BulkResponse{Response: resp.OK(), Deleted: deleted})
+	}
+}
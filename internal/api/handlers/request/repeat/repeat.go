@@ -47,7 +47,7 @@ func New(log *slog.Logger, requestGetter RequestGetter, proxyRT http.RoundTrippe
 			return err
 		}
 
-		response, err := RepeatRequest([]byte(request.Request.Raw), proxyRT)
+		response, err := RepeatRequest([]byte(request.Request.Raw), request.Request.Scheme, proxyRT)
 
 		if err != nil {
 			log.Error("failed to RepeatRequest", sl.Err(err))
@@ -65,7 +65,7 @@ func New(log *slog.Logger, requestGetter RequestGetter, proxyRT http.RoundTrippe
 	}
 }
 
-func RepeatRequest(rawRequest []byte, proxyRT http.RoundTripper) ([]byte, error) {
+func RepeatRequest(rawRequest []byte, scheme string, proxyRT http.RoundTripper) ([]byte, error) {
 	r, err := http.ReadRequest(bufio.NewReader(bytes.NewBuffer(rawRequest)))
 	if err != nil {
 		return nil, fmt.Errorf("error in client DO: %w", err)
@@ -76,7 +76,10 @@ func RepeatRequest(rawRequest []byte, proxyRT http.RoundTripper) ([]byte, error)
 	}
 	r.Header.Add("TrueProxy-Repeated", "TrueProxy")
 
-	proxy.ChangeRequestToTarget(r, r.Host, proxy.HTTPS)
+	if scheme == "" {
+		scheme = proxy.HTTPS
+	}
+	proxy.ChangeRequestToTarget(r, r.Host, scheme)
 
 	client := http.Client{
 		//Transport: http.DefaultTransport,
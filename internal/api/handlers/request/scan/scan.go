@@ -22,7 +22,7 @@ type RequestGetter interface {
 	ReadRequest(uint) (models.RequestResponse, error)
 }
 
-func New(log *slog.Logger, requestGetter RequestGetter) echo.HandlerFunc {
+func New(log *slog.Logger, requestGetter RequestGetter, transport http.RoundTripper) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		const op = "api.request.scan.New"
 
@@ -48,7 +48,7 @@ func New(log *slog.Logger, requestGetter RequestGetter) echo.HandlerFunc {
 		}
 
 		for _, promt := range dict {
-			flag, err := CmdInjectionCheck([]byte(request.Request.Raw), promt)
+			flag, err := CmdInjectionCheck([]byte(request.Request.Raw), request.Request.Scheme, promt, transport)
 			if err != nil {
 				log.Error("failed to CmdInjectionCheck", sl.Err(err))
 
@@ -69,7 +69,7 @@ var dict = [...]string{
 	"`cat /etc/passwd`",
 }
 
-func CmdInjectionCheck(rawRequest []byte, bash string) (bool, error) {
+func CmdInjectionCheck(rawRequest []byte, scheme string, bash string, transport http.RoundTripper) (bool, error) {
 	r, err := http.ReadRequest(bufio.NewReader(bytes.NewBuffer(rawRequest)))
 	if err != nil {
 		return false, fmt.Errorf("error in client DO: %w", err)
@@ -78,14 +78,17 @@ func CmdInjectionCheck(rawRequest []byte, bash string) (bool, error) {
 	if r.ContentLength == 0 {
 		r.Body = nil
 	}
-	proxy.ChangeRequestToTarget(r, r.Host, proxy.HTTPS)
+	if scheme == "" {
+		scheme = proxy.HTTPS
+	}
+	proxy.ChangeRequestToTarget(r, r.Host, scheme)
 
 	for k := range r.Header {
 		r.Header[k] = append(r.Header[k], bash)
 	}
 
 	client := http.Client{
-		Transport: http.DefaultTransport,
+		Transport: transport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
@@ -0,0 +1,64 @@
+package search
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	resp "github.com/mrdjeb/trueproxy/internal/api/response"
+	"github.com/mrdjeb/trueproxy/internal/logger/sl"
+	"github.com/mrdjeb/trueproxy/internal/models"
+	"github.com/mrdjeb/trueproxy/internal/storage"
+)
+
+type RequestSearcher interface {
+	SearchRequests(text string, limit, offset int) ([]models.SearchResult, error)
+}
+
+func New(log *slog.Logger, requestSearcher RequestSearcher) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		const op = "api.request.search.New"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", c.Request().Header.Get(echo.HeaderXRequestID)),
+		)
+
+		var text string
+		var limit, offset int
+		err := echo.QueryParamsBinder(c).
+			MustString("text", &text).
+			Int("limit", &limit).
+			Int("offset", &offset).
+			BindError()
+		if err != nil {
+			log.Error("failed to bind search", sl.Err(err))
+
+			c.JSON(http.StatusBadRequest, resp.Err("bad search, text is required"))
+			return err
+		}
+
+		results, err := requestSearcher.SearchRequests(text, limit, offset)
+		if err != nil {
+			switch {
+			case errors.Is(err, storage.ErrBadFilter):
+				log.Warn("bad search", sl.Err(err))
+
+				c.JSON(http.StatusBadRequest, resp.Err(err.Error()))
+				return err
+			case errors.Is(err, storage.ErrSearchUnavailable):
+				log.Error("search unavailable", sl.Err(err))
+
+				c.JSON(http.StatusNotImplemented, resp.Err(storage.ErrSearchUnavailable.Error()))
+				return err
+			}
+			log.Error("failed to requestSearcher", sl.Err(err))
+
+			c.JSON(http.StatusInternalServerError, resp.Err("internal error"))
+			return err
+		}
+
+		return c.JSON(http.StatusOK, results)
+	}
+}
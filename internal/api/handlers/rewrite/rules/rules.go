@@ -0,0 +1,36 @@
+package rules
+
+import (
+	"log/slog"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrdjeb/trueproxy/internal/api/handlers/rulecrud"
+	"github.com/mrdjeb/trueproxy/internal/models"
+	"github.com/mrdjeb/trueproxy/internal/rewrite"
+)
+
+type RulesManager = rulecrud.RulesManager[models.RewriteRule]
+
+func handlers(manager RulesManager) rulecrud.Handlers[models.RewriteRule] {
+	return rulecrud.Handlers[models.RewriteRule]{
+		Op:         "api.rewrite.rules",
+		Manager:    manager,
+		ErrBadRule: rewrite.ErrBadRule,
+	}
+}
+
+func NewList(log *slog.Logger, manager RulesManager) echo.HandlerFunc {
+	return handlers(manager).NewList(log)
+}
+
+func NewCreate(log *slog.Logger, manager RulesManager) echo.HandlerFunc {
+	return handlers(manager).NewCreate(log)
+}
+
+func NewUpdate(log *slog.Logger, manager RulesManager) echo.HandlerFunc {
+	return handlers(manager).NewUpdate(log)
+}
+
+func NewDelete(log *slog.Logger, manager RulesManager) echo.HandlerFunc {
+	return handlers(manager).NewDelete(log)
+}
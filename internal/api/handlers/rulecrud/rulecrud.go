@@ -0,0 +1,167 @@
+// Package rulecrud serves list, create, update and delete of stored rules,
+// rewrite and scope rules are managed through the same API.
+package rulecrud
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	resp "github.com/mrdjeb/trueproxy/internal/api/response"
+	"github.com/mrdjeb/trueproxy/internal/logger/sl"
+	"github.com/mrdjeb/trueproxy/internal/storage"
+)
+
+type RulesManager[T any] interface {
+	Rules() ([]T, error)
+	AddRule(T) (T, error)
+	UpdateRule(uint, T) (T, error)
+	DeleteRule(uint) error
+}
+
+// Handlers are bound to one kind of rules.
+type Handlers[T any] struct {
+	// Op prefixes op of the logs, like "api.rewrite.rules".
+	Op      string
+	Manager RulesManager[T]
+	// ErrBadRule wraps validation errors of the manager, they are answered
+	// with 400 and the reason.
+	ErrBadRule error
+}
+
+func (h Handlers[T]) NewList(log *slog.Logger) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		op := h.Op + ".NewList"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", c.Request().Header.Get(echo.HeaderXRequestID)),
+		)
+
+		rules, err := h.Manager.Rules()
+		if err != nil {
+			log.Error("failed to read rules", sl.Err(err))
+
+			c.JSON(http.StatusInternalServerError, resp.Err("internal error"))
+			return err
+		}
+
+		return c.JSON(http.StatusOK, rules)
+	}
+}
+
+func (h Handlers[T]) NewCreate(log *slog.Logger) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		op := h.Op + ".NewCreate"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", c.Request().Header.Get(echo.HeaderXRequestID)),
+		)
+
+		var rule T
+		if err := c.Bind(&rule); err != nil {
+			log.Error("failed to bind rule", sl.Err(err))
+
+			c.JSON(http.StatusBadRequest, resp.Err("bad rule"))
+			return err
+		}
+
+		rule, err := h.Manager.AddRule(rule)
+		if err != nil {
+			if errors.Is(err, h.ErrBadRule) {
+				log.Warn("rejected rule", sl.Err(err))
+
+				c.JSON(http.StatusBadRequest, resp.Err(err.Error()))
+				return err
+			}
+			log.Error("failed to add rule", sl.Err(err))
+
+			c.JSON(http.StatusInternalServerError, resp.Err("internal error"))
+			return err
+		}
+
+		return c.JSON(http.StatusCreated, rule)
+	}
+}
+
+func (h Handlers[T]) NewUpdate(log *slog.Logger) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		op := h.Op + ".NewUpdate"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", c.Request().Header.Get(echo.HeaderXRequestID)),
+		)
+
+		id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			log.Error("failed to ParseUint ID", sl.Err(err))
+
+			c.JSON(http.StatusBadRequest, resp.Err("bad id"))
+			return err
+		}
+
+		var rule T
+		if err := c.Bind(&rule); err != nil {
+			log.Error("failed to bind rule", sl.Err(err))
+
+			c.JSON(http.StatusBadRequest, resp.Err("bad rule"))
+			return err
+		}
+
+		rule, err = h.Manager.UpdateRule(uint(id), rule)
+		if err != nil {
+			if errors.Is(err, storage.ErrRuleNotFound) {
+				c.JSON(http.StatusNotFound, resp.Err(err.Error()))
+				return err
+			}
+			if errors.Is(err, h.ErrBadRule) {
+				log.Warn("rejected rule", sl.Err(err))
+
+				c.JSON(http.StatusBadRequest, resp.Err(err.Error()))
+				return err
+			}
+			log.Error("failed to update rule", sl.Err(err))
+
+			c.JSON(http.StatusInternalServerError, resp.Err("internal error"))
+			return err
+		}
+
+		return c.JSON(http.StatusOK, rule)
+	}
+}
+
+func (h Handlers[T]) NewDelete(log *slog.Logger) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		op := h.Op + ".NewDelete"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", c.Request().Header.Get(echo.HeaderXRequestID)),
+		)
+
+		id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			log.Error("failed to ParseUint ID", sl.Err(err))
+
+			c.JSON(http.StatusBadRequest, resp.Err("bad id"))
+			return err
+		}
+
+		if err := h.Manager.DeleteRule(uint(id)); err != nil {
+			if errors.Is(err, storage.ErrRuleNotFound) {
+				c.JSON(http.StatusNotFound, resp.Err(err.Error()))
+				return err
+			}
+			log.Error("failed to delete rule", sl.Err(err))
+
+			c.JSON(http.StatusInternalServerError, resp.Err("internal error"))
+			return err
+		}
+
+		return c.JSON(http.StatusOK, resp.OK())
+	}
+}
@@ -0,0 +1,36 @@
+package rules
+
+import (
+	"log/slog"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrdjeb/trueproxy/internal/api/handlers/rulecrud"
+	"github.com/mrdjeb/trueproxy/internal/models"
+	"github.com/mrdjeb/trueproxy/internal/scope"
+)
+
+type RulesManager = rulecrud.RulesManager[models.ScopeRule]
+
+func handlers(manager RulesManager) rulecrud.Handlers[models.ScopeRule] {
+	return rulecrud.Handlers[models.ScopeRule]{
+		Op:         "api.scope.rules",
+		Manager:    manager,
+		ErrBadRule: scope.ErrBadRule,
+	}
+}
+
+func NewList(log *slog.Logger, manager RulesManager) echo.HandlerFunc {
+	return handlers(manager).NewList(log)
+}
+
+func NewCreate(log *slog.Logger, manager RulesManager) echo.HandlerFunc {
+	return handlers(manager).NewCreate(log)
+}
+
+func NewUpdate(log *slog.Logger, manager RulesManager) echo.HandlerFunc {
+	return handlers(manager).NewUpdate(log)
+}
+
+func NewDelete(log *slog.Logger, manager RulesManager) echo.HandlerFunc {
+	return handlers(manager).NewDelete(log)
+}
@@ -0,0 +1,29 @@
+package stats
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrdjeb/trueproxy/internal/writequeue"
+)
+
+type StatsGetter interface {
+	Stats() writequeue.Stats
+}
+
+func New(log *slog.Logger, statsGetter StatsGetter) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		const op = "api.storage.stats.New"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", c.Request().Header.Get(echo.HeaderXRequestID)),
+		)
+
+		stats := statsGetter.Stats()
+		log.Debug("write queue stats", slog.Uint64("dropped", stats.Dropped), slog.Uint64("failed", stats.Failed))
+
+		return c.JSON(http.StatusOK, stats)
+	}
+}
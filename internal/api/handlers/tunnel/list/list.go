@@ -0,0 +1,36 @@
+package list
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	resp "github.com/mrdjeb/trueproxy/internal/api/response"
+	"github.com/mrdjeb/trueproxy/internal/logger/sl"
+	"github.com/mrdjeb/trueproxy/internal/models"
+)
+
+type TunnelListGetter interface {
+	ReadTunnels() ([]models.Tunnel, error)
+}
+
+func New(log *slog.Logger, tunnelListGetter TunnelListGetter) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		const op = "api.tunnel.list.New"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", c.Request().Header.Get(echo.HeaderXRequestID)),
+		)
+
+		tunnels, err := tunnelListGetter.ReadTunnels()
+		if err != nil {
+			log.Error("failed to tunnelListGetter", sl.Err(err))
+
+			c.JSON(http.StatusInternalServerError, resp.Err("internal error"))
+			return err
+		}
+
+		return c.JSON(http.StatusOK, tunnels)
+	}
+}
@@ -0,0 +1,256 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+
+	"github.com/mrdjeb/trueproxy/internal/config"
+)
+
+const (
+	KeyRSA2048   = "rsa2048"
+	KeyRSA3072   = "rsa3072"
+	KeyRSA4096   = "rsa4096"
+	KeyECDSAP256 = "ecdsa-p256"
+	KeyECDSAP384 = "ecdsa-p384"
+	KeyEd25519   = "ed25519"
+
+	FormatPEM = "pem"
+	FormatDER = "der"
+	FormatP12 = "p12"
+)
+
+var (
+	ErrExists = errors.New("CA already exists")
+)
+
+// Options describe a new CA.
+type Options struct {
+	KeyType      string
+	Lifetime     time.Duration
+	CommonName   string
+	Organization string
+}
+
+var keyGenerators = map[string]func() (crypto.Signer, error){
+	KeyRSA2048:   func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 2048) },
+	KeyRSA3072:   func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 3072) },
+	KeyRSA4096:   func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 4096) },
+	KeyECDSAP256: func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P256(), rand.Reader) },
+	KeyECDSAP384: func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P384(), rand.Reader) },
+	KeyEd25519: func() (crypto.Signer, error) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	},
+}
+
+// GenerateKey creates a private key of keyType, one of the Key constants.
+func GenerateKey(keyType string) (crypto.Signer, error) {
+	generate, ok := keyGenerators[keyType]
+	if !ok {
+		return nil, fmt.Errorf("unknown key type %q", keyType)
+	}
+	return generate()
+}
+
+// Generate creates a self-signed CA and returns its certificate and private
+// key PEM encoded.
+func Generate(opts Options) ([]byte, []byte, error) {
+	key, err := GenerateKey(opts.KeyType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pkixpub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	keyID := sha1.Sum(pkixpub)
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   opts.CommonName,
+			Organization: []string{opts.Organization},
+		},
+		SubjectKeyId:          keyID[:],
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(opts.Lifetime),
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// Exists reports whether any of the CA files is already on disk.
+func Exists(cfg config.Cert) bool {
+	for _, name := range []string{cfg.CACertFile, cfg.CAKeyFile} {
+		if _, err := os.Stat(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Init generates a CA and writes it to the paths from cfg. Existing files
+// are overwritten only with force.
+func Init(cfg config.Cert, opts Options, force bool) error {
+	if _, ok := keyGenerators[opts.KeyType]; !ok {
+		return fmt.Errorf("unknown key type %q", opts.KeyType)
+	}
+	if !force && Exists(cfg) {
+		return ErrExists
+	}
+
+	certPEM, keyPEM, err := Generate(opts)
+	if err != nil {
+		return err
+	}
+
+	// Both files are written aside first, so a failed write never leaves
+	// a half written file or a key without its certificate in place.
+	keyTmp, err := writeTemp(cfg.CAKeyFile, keyPEM, 0o600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(keyTmp)
+	certTmp, err := writeTemp(cfg.CACertFile, certPEM, 0o644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(certTmp)
+
+	if err := os.Rename(keyTmp, cfg.CAKeyFile); err != nil {
+		return err
+	}
+	return os.Rename(certTmp, cfg.CACertFile)
+}
+
+// writeTemp writes data to a new temporary file next to name and returns
+// its path, ready to be renamed over name.
+func writeTemp(name string, data []byte, perm os.FileMode) (string, error) {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Load reads the CA from the paths from cfg. RSA, ECDSA and Ed25519 keys
+// are supported.
+func Load(cfg config.Cert) (*x509.Certificate, crypto.Signer, error) {
+	tlsCert, err := tls.LoadX509KeyPair(cfg.CACertFile, cfg.CAKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, ok := tlsCert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported CA key type %T", tlsCert.PrivateKey)
+	}
+
+	ca, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, key, nil
+}
+
+// Export writes the CA certificate in format. The private key is included
+// only with withKey, DER holds the certificate alone.
+func Export(w io.Writer, ca *x509.Certificate, key crypto.PrivateKey, format string, withKey bool, password string) error {
+	switch format {
+	case FormatPEM:
+		if err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}); err != nil {
+			return err
+		}
+		if !withKey {
+			return nil
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		return pem.Encode(w, &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	case FormatDER:
+		if withKey {
+			return errors.New("DER holds the certificate only")
+		}
+		_, err := w.Write(ca.Raw)
+		return err
+
+	case FormatP12:
+		// Legacy encryption is the one phones and older systems can import.
+		var data []byte
+		var err error
+		if withKey {
+			data, err = pkcs12.Legacy.Encode(key, ca, nil, password)
+		} else {
+			data, err = pkcs12.Legacy.EncodeTrustStore([]*x509.Certificate{ca}, password)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
@@ -0,0 +1,114 @@
+package ca
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mrdjeb/trueproxy/internal/config"
+)
+
+const usage = `usage: trueproxy [flags] ca <command> [options]
+
+commands:
+  init    generate a new CA at -ca-cert and -ca-key paths
+  export  write the CA in PEM, DER or PKCS#12 format
+`
+
+// DefaultOptions is the CA generated when none exists at startup.
+func DefaultOptions(cfg config.Cert) Options {
+	return Options{
+		KeyType:      cfg.CAKeyType,
+		Lifetime:     10 * 365 * 24 * time.Hour,
+		CommonName:   cfg.Organization + " CA",
+		Organization: cfg.Organization,
+	}
+}
+
+// Run executes the ca subcommand with args following "ca".
+func Run(cfg config.Cert, args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return flag.ErrHelp
+	}
+
+	switch args[0] {
+	case "init":
+		return runInit(cfg, args[1:], stdout, stderr)
+	case "export":
+		return runExport(cfg, args[1:], stdout, stderr)
+	}
+	fmt.Fprint(stderr, usage)
+	return fmt.Errorf("unknown ca command %q", args[0])
+}
+
+func runInit(cfg config.Cert, args []string, stdout, stderr io.Writer) error {
+	opts := DefaultOptions(cfg)
+
+	fs := flag.NewFlagSet("ca init", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&opts.KeyType, "key-type", opts.KeyType, "CA key type: rsa2048, rsa3072, rsa4096, ecdsa-p256, ecdsa-p384 or ed25519")
+	fs.DurationVar(&opts.Lifetime, "lifetime", opts.Lifetime, "CA certificate lifetime")
+	fs.StringVar(&opts.CommonName, "cn", opts.CommonName, "CA subject common name")
+	fs.StringVar(&opts.Organization, "org", opts.Organization, "CA subject organization")
+	force := fs.Bool("force", false, "overwrite existing CA files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := Init(cfg, opts, *force); err != nil {
+		if errors.Is(err, ErrExists) {
+			return fmt.Errorf("%w at %s, %s: use -force to replace it", err, cfg.CACertFile, cfg.CAKeyFile)
+		}
+		return err
+	}
+
+	fmt.Fprintf(stdout, "CA written to %s and %s\n", cfg.CACertFile, cfg.CAKeyFile)
+	return nil
+}
+
+func runExport(cfg config.Cert, args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("ca export", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	format := fs.String("format", FormatPEM, "output format: pem, der or p12")
+	out := fs.String("out", "-", "output file, - for stdout")
+	withKey := fs.Bool("with-key", false, "include the CA private key (pem and p12 only)")
+	password := fs.String("password", "", "PKCS#12 password")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ca, key, err := Load(cfg)
+	if err != nil {
+		return err
+	}
+
+	if *out == "-" {
+		return Export(stdout, ca, key, *format, *withKey, *password)
+	}
+
+	perm := os.FileMode(0o644)
+	if *withKey {
+		perm = 0o600
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	// OpenFile sets perm only on new files, an existing one is narrowed
+	// before the key lands in it.
+	if *withKey {
+		if err := f.Chmod(perm); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := Export(f, ca, key, *format, *withKey, *password); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"flag"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -9,7 +11,11 @@ type Config struct {
 	LogEnviroment           string
 	Cert                    Cert
 	ProxyServer             ProxyServer
+	SocksServer             SocksServer
+	TransparentServer       TransparentServer
 	ApiServer               ApiServer
+	Retention               Retention
+	WriteQueue              WriteQueue
 	GracefulShotdownTimeout time.Duration
 }
 type ProxyServer struct {
@@ -18,6 +24,35 @@ type ProxyServer struct {
 	WriteTimeout      time.Duration
 	IdleTimeout       time.Duration
 	ReadHeaderTimeout time.Duration
+	Streaming         bool
+	CaptureBodyLimit  int
+	InterceptTimeout  time.Duration // held request is forwarded as is after it
+	OutOfScope        string        // forward or tunnel traffic out of project scope, it is never stored
+	CAPageHost        string        // hostname answered by the proxy with the CA download page
+	Passthrough       []string      // host patterns tunneled without MITM, e.g. "*.apple.com"
+	PassthroughAuto   bool          // tunnel hosts whose clients rejected the forged certificate
+	Upstream          Upstream
+	Reverse           string // fixed upstream url, turns the proxy listener into a reverse proxy
+	ReverseTLS        bool   // terminate TLS on the reverse proxy listener
+}
+
+// Upstream configures outgoing traffic: a proxy it is chained through,
+// host address overrides and per-host TLS settings.
+type Upstream struct {
+	URL      string // http://, https:// or socks5://, empty for direct connections
+	Username string
+	Password string
+	Bypass   []string // host patterns connected directly, e.g. "*.local"
+	TLSFile  string   // JSON file with per-host root CAs, client certificates and verification settings
+	Hosts    []string // "pattern=address" overrides, e.g. "api.example.com=127.0.0.1:8080"
+}
+
+type SocksServer struct {
+	Address string // empty disables SOCKS5 listener
+}
+
+type TransparentServer struct {
+	Address string // empty disables listener for iptables REDIRECT/TPROXY traffic
 }
 
 type ApiServer struct {
@@ -29,10 +64,30 @@ type ApiServer struct {
 	GracefulShotdownTimeout time.Duration
 }
 
+// Retention limits stored traffic, zero values are unlimited.
+type Retention struct {
+	MaxAge       time.Duration
+	MaxRows      int64
+	MaxBodyBytes int64         // request and response bodies together
+	Interval     time.Duration // between purges
+}
+
+// WriteQueue buffers captured traffic on its way to storage.
+type WriteQueue struct {
+	Size       int // writes waiting for storage, more are dropped
+	Retries    int
+	RetryDelay time.Duration // doubled after every retry
+}
+
 type Cert struct {
 	CACertFile   string
 	CAKeyFile    string
+	CAKeyType    string // key type of a CA generated at startup
 	Organization string
+	CacheSize    int    // forged leaf certificates kept in memory, 0 disables cache
+	Mimic        bool   // copy subject, SANs, key usage and validity of the real server certificate
+	LeafKey      string // key type of forged leaf certificates
+	LeafPerHost  bool   // generate a key per forged certificate instead of one shared key
 }
 
 func MustLoad() *Config {
@@ -46,6 +101,12 @@ func MustLoad() *Config {
 			WriteTimeout:      4 * time.Second,
 			IdleTimeout:       30 * time.Second,
 			ReadHeaderTimeout: 10 * time.Second,
+			Streaming:         true,
+			CaptureBodyLimit:  10 << 20,
+			InterceptTimeout:  2 * time.Minute,
+			OutOfScope:        "forward",
+			PassthroughAuto:   true,
+			CAPageHost:        "trueproxy",
 		},
 		ApiServer: ApiServer{
 			Address:           net.JoinHostPort("0.0.0.0", "62802"),
@@ -58,10 +119,66 @@ func MustLoad() *Config {
 		Cert: Cert{
 			CACertFile:   "./certs/TrueProxyCA.crt",
 			CAKeyFile:    "./certs/TrueProxyCA.key",
+			CAKeyType:    "rsa2048",
 			Organization: "TrueProxy",
+			CacheSize:    1024,
+			LeafKey:      "rsa2048",
+		},
+		Retention: Retention{
+			Interval: time.Minute,
+		},
+		WriteQueue: WriteQueue{
+			Size:       4096,
+			Retries:    3,
+			RetryDelay: 100 * time.Millisecond,
 		},
 		GracefulShotdownTimeout: 10 * time.Second,
 	}
 
+	flag.StringVar(&cfg.Cert.CACertFile, "ca-cert", cfg.Cert.CACertFile, "CA certificate file, generated if missing")
+	flag.StringVar(&cfg.Cert.CAKeyFile, "ca-key", cfg.Cert.CAKeyFile, "CA private key file, generated if missing")
+	flag.StringVar(&cfg.Cert.CAKeyType, "ca-key-type", cfg.Cert.CAKeyType, "key type of a CA generated at startup: rsa2048, rsa3072, rsa4096, ecdsa-p256, ecdsa-p384 or ed25519")
+	flag.StringVar(&cfg.Cert.LeafKey, "leaf-key", cfg.Cert.LeafKey, "key type of forged certificates: rsa2048, rsa3072, rsa4096, ecdsa-p256, ecdsa-p384 or ed25519")
+	flag.BoolVar(&cfg.Cert.LeafPerHost, "leaf-key-per-host", false, "generate a separate key for every forged certificate instead of sharing one")
+	flag.BoolVar(&cfg.Cert.Mimic, "mimic-cert", false, "copy subject, SANs, key usage and validity of the real server certificate into forged ones")
+	flag.IntVar(&cfg.Cert.CacheSize, "cert-cache", cfg.Cert.CacheSize, "forged leaf certificates kept in memory, 0 disables cache")
+	flag.StringVar(&cfg.SocksServer.Address, "socks", "", "SOCKS5 listener address, e.g. 0.0.0.0:62803")
+	flag.StringVar(&cfg.TransparentServer.Address, "transparent", "", "transparent proxy listener address for iptables REDIRECT/TPROXY, e.g. 0.0.0.0:62804")
+	flag.StringVar(&cfg.ProxyServer.Reverse, "reverse", "", "run as reverse proxy in front of upstream url, e.g. http://localhost:9000")
+	flag.BoolVar(&cfg.ProxyServer.ReverseTLS, "reverse-tls", false, "terminate TLS on reverse proxy listener with a certificate signed by CA")
+	flag.DurationVar(&cfg.ProxyServer.InterceptTimeout, "intercept-timeout", cfg.ProxyServer.InterceptTimeout, "held request or response is forwarded unchanged after this timeout")
+	flag.StringVar(&cfg.ProxyServer.OutOfScope, "out-of-scope", cfg.ProxyServer.OutOfScope, "out of scope traffic: forward (intercept without storing) or tunnel (no MITM for excluded hosts)")
+	flag.StringVar(&cfg.ProxyServer.CAPageHost, "ca-page-host", cfg.ProxyServer.CAPageHost, "hostname answered with the CA download page, empty disables it")
+	passthrough := flag.String("passthrough", "", "comma separated host patterns tunneled without MITM")
+	flag.BoolVar(&cfg.ProxyServer.PassthroughAuto, "passthrough-auto", cfg.ProxyServer.PassthroughAuto, "tunnel hosts whose clients rejected the forged certificate")
+	flag.StringVar(&cfg.ProxyServer.Upstream.URL, "upstream", "", "upstream proxy url: http://, https:// or socks5://host:port")
+	flag.StringVar(&cfg.ProxyServer.Upstream.Username, "upstream-user", "", "upstream proxy username")
+	flag.StringVar(&cfg.ProxyServer.Upstream.Password, "upstream-pass", "", "upstream proxy password")
+	flag.StringVar(&cfg.ProxyServer.Upstream.TLSFile, "upstream-tls", "", "JSON file with per-host TLS settings of outgoing connections")
+	hosts := flag.String("hosts", "", "comma separated host address overrides, e.g. \"api.example.com=127.0.0.1:8080,*.dev.local=10.0.0.5\"")
+	upstreamBypass := flag.String("upstream-bypass", "", "comma separated host patterns connected without upstream proxy")
+	flag.DurationVar(&cfg.Retention.MaxAge, "retention-max-age", 0, "delete requests older than this, e.g. 72h, 0 keeps them")
+	flag.Int64Var(&cfg.Retention.MaxRows, "retention-max-rows", 0, "keep at most this many newest requests, 0 is unlimited")
+	flag.Int64Var(&cfg.Retention.MaxBodyBytes, "retention-max-body-bytes", 0, "keep newest requests while their bodies fit in this many bytes, 0 is unlimited")
+	flag.DurationVar(&cfg.Retention.Interval, "retention-interval", cfg.Retention.Interval, "how often retention limits are applied")
+	flag.IntVar(&cfg.WriteQueue.Size, "write-queue", cfg.WriteQueue.Size, "captured requests, frames and tunnels waiting for storage, more are dropped")
+	flag.IntVar(&cfg.WriteQueue.Retries, "write-retries", cfg.WriteQueue.Retries, "retries of a failed storage write")
+	flag.DurationVar(&cfg.WriteQueue.RetryDelay, "write-retry-delay", cfg.WriteQueue.RetryDelay, "delay before the first retry of a failed storage write, doubled after each")
+	flag.Parse()
+
+	cfg.ProxyServer.Passthrough = splitList(*passthrough)
+	cfg.ProxyServer.Upstream.Bypass = splitList(*upstreamBypass)
+	cfg.ProxyServer.Upstream.Hosts = splitList(*hosts)
+
 	return &cfg
 }
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
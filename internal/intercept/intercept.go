@@ -0,0 +1,230 @@
+package intercept
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	StageRequest  = "request"
+	StageResponse = "response"
+	StageBoth     = "both"
+
+	ActionForward = "forward"
+	ActionDrop    = "drop"
+)
+
+var (
+	ErrItemNotFound = errors.New("intercepted item not found")
+	ErrRuleNotFound = errors.New("intercept rule not found")
+	ErrDropped      = errors.New("dropped by intercept")
+)
+
+// Rule holds matching requests, or their responses, until they are resolved.
+type Rule struct {
+	ID      uint   `json:"id"`
+	Stage   string `json:"stage"`
+	Method  string `json:"method,omitempty"`
+	Host    string `json:"host,omitempty"`    // glob, e.g. *.example.com
+	Path    string `json:"path,omitempty"`    // regular expression
+	Timeout int    `json:"timeout,omitempty"` // seconds before auto forward, default if zero
+
+	path *regexp.Regexp
+}
+
+func (r *Rule) match(stage, method, host, urlPath string) bool {
+	if r.Stage != StageBoth && r.Stage != stage {
+		return false
+	}
+	if r.Method != "" && !strings.EqualFold(r.Method, method) {
+		return false
+	}
+	if r.Host != "" {
+		if ok, _ := path.Match(strings.ToLower(r.Host), strings.ToLower(host)); !ok {
+			return false
+		}
+	}
+	return r.path == nil || r.path.MatchString(urlPath)
+}
+
+// Item is a held request or response waiting for a decision.
+type Item struct {
+	ID       string    `json:"id"`
+	Stage    string    `json:"stage"`
+	Method   string    `json:"method"`
+	Host     string    `json:"host"`
+	Path     string    `json:"path"`
+	Raw      string    `json:"raw"`
+	Created  time.Time `json:"created"`
+	Deadline time.Time `json:"deadline"`
+	// BodyOmitted is set when Raw has the head only, an edited head is sent
+	// with the original body.
+	BodyOmitted bool `json:"body_omitted"`
+
+	decision chan Decision
+}
+
+// Decision resolves an item. Empty Raw forwards the original message.
+type Decision struct {
+	Action string
+	Raw    string
+}
+
+// Queue keeps breakpoint rules and items held by them. It is safe for
+// concurrent use by any number of blocked connections.
+type Queue struct {
+	timeout time.Duration
+
+	mu         sync.Mutex
+	rules      []Rule
+	nextRuleID uint
+	items      map[string]*Item
+}
+
+func New(timeout time.Duration) *Queue {
+	return &Queue{
+		timeout: timeout,
+		items:   make(map[string]*Item),
+	}
+}
+
+func (q *Queue) Rules() []Rule {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]Rule{}, q.rules...)
+}
+
+func (q *Queue) AddRule(rule Rule) (Rule, error) {
+	switch rule.Stage {
+	case StageRequest, StageResponse, StageBoth:
+	case "":
+		rule.Stage = StageRequest
+	default:
+		return Rule{}, fmt.Errorf("unknown stage %q", rule.Stage)
+	}
+	if rule.Host != "" {
+		if _, err := path.Match(rule.Host, ""); err != nil {
+			return Rule{}, fmt.Errorf("bad host pattern: %w", err)
+		}
+	}
+	if rule.Path != "" {
+		re, err := regexp.Compile(rule.Path)
+		if err != nil {
+			return Rule{}, fmt.Errorf("bad path regexp: %w", err)
+		}
+		rule.path = re
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.nextRuleID++
+	rule.ID = q.nextRuleID
+	q.rules = append(q.rules, rule)
+	return rule, nil
+}
+
+func (q *Queue) DeleteRule(id uint) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, rule := range q.rules {
+		if rule.ID == id {
+			q.rules = append(q.rules[:i], q.rules[i+1:]...)
+			return nil
+		}
+	}
+	return ErrRuleNotFound
+}
+
+// Match returns the first rule holding the message and whether there is one.
+func (q *Queue) Match(stage, method, host, urlPath string) (Rule, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, rule := range q.rules {
+		if rule.match(stage, method, host, urlPath) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+func (q *Queue) Pending() []Item {
+	q.mu.Lock()
+	items := make([]Item, 0, len(q.items))
+	for _, item := range q.items {
+		items = append(items, *item)
+	}
+	q.mu.Unlock()
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Created.Before(items[j].Created)
+	})
+	return items
+}
+
+func (q *Queue) Resolve(id string, decision Decision) error {
+	switch decision.Action {
+	case ActionForward, ActionDrop:
+	default:
+		return fmt.Errorf("unknown action %q", decision.Action)
+	}
+
+	q.mu.Lock()
+	item, ok := q.items[id]
+	delete(q.items, id)
+	q.mu.Unlock()
+
+	if !ok {
+		return ErrItemNotFound
+	}
+	item.decision <- decision
+	return nil
+}
+
+// Hold blocks until the item is resolved through the API. It forwards the
+// original message once the rule timeout expires or ctx is done.
+func (q *Queue) Hold(ctx context.Context, rule Rule, item Item) Decision {
+	timeout := q.timeout
+	if rule.Timeout > 0 {
+		timeout = time.Duration(rule.Timeout) * time.Second
+	}
+
+	item.ID = uuid.New().String()
+	item.Created = time.Now()
+	item.Deadline = item.Created.Add(timeout)
+	item.decision = make(chan Decision, 1)
+
+	q.mu.Lock()
+	q.items[item.ID] = &item
+	q.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case decision := <-item.decision:
+		return decision
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	delete(q.items, item.ID)
+	q.mu.Unlock()
+
+	// Resolve may have won the race right before removal.
+	select {
+	case decision := <-item.decision:
+		return decision
+	default:
+		return Decision{Action: ActionForward}
+	}
+}
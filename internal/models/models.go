@@ -1,17 +1,92 @@
 package models
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
 type RequestResponse struct {
 	gorm.Model
-	Request  Request  `gorm:"embedded"`
-	Response Response `gorm:"embedded"`
+	Request    Request  `gorm:"embedded"`
+	Response   Response `gorm:"embedded"`
+	OutOfScope bool     `gorm:"index"` // kept up to date when scope rules change
+
+	UpstreamChain       []CertInfo `gorm:"serializer:json"` // certificates presented by the HTTPS upstream
+	UpstreamTLSVersion  string     // negotiated with the HTTPS upstream, e.g. "TLS 1.3"
+	UpstreamCipher      string
+	UpstreamFingerprint string // SHA-256 of the upstream leaf certificate
+	UpstreamAddr        string // address the request was sent to, the proxy one if chained
+
+	ClientHello ClientHello `gorm:"embedded;embeddedPrefix:client_"` // offered by the client opening the TLS tunnel
+}
+
+// ClientHello is what a client offered in its TLS handshake.
+type ClientHello struct {
+	SNI          string   `gorm:"index"`
+	ALPN         []string `gorm:"serializer:json"`
+	Versions     []string `gorm:"serializer:json"`
+	CipherSuites []string `gorm:"serializer:json"`
+	JA3          string
+	JA3Hash      string `gorm:"index"` // MD5 of JA3
+	JA4          string `gorm:"index"`
+}
+
+// RequestSummary is the listing projection of RequestResponse, without
+// bodies, raw dumps and header maps.
+type RequestSummary struct {
+	ID          uint
+	CreatedAt   time.Time
+	Method      string
+	Scheme      string
+	Host        string
+	Path        string
+	StatusCode  int
+	ContentType string
+	OutOfScope  bool
+}
+
+const (
+	SearchRequestHeaders  = "request_headers"
+	SearchRequestBody     = "request_body"
+	SearchResponseHeaders = "response_headers"
+	SearchResponseBody    = "response_body"
+)
+
+// SearchResult is a request matching full-text search.
+type SearchResult struct {
+	RequestSummary
+	Matches []SearchMatch
+}
+
+// SearchMatch is a highlighted snippet of the matching Part, one of the
+// Search constants.
+type SearchMatch struct {
+	Part    string
+	Snippet string
+}
+
+// CertInfo is what is worth inspecting in a certificate.
+type CertInfo struct {
+	Subject            string
+	Issuer             string
+	SerialNumber       string
+	NotBefore          time.Time
+	NotAfter           time.Time
+	DNSNames           []string `json:",omitempty"`
+	IPAddresses        []string `json:",omitempty"`
+	KeyUsage           []string `json:",omitempty"`
+	ExtKeyUsage        []string `json:",omitempty"`
+	SignatureAlgorithm string
+	PublicKeyAlgorithm string
+	SHA256             string
+	IsCA               bool
 }
 
 type Request struct {
 	Method     string
+	Proto      string
+	Scheme     string
 	Path       string
 	Host       string
 	GetParams  map[string][]string `gorm:"serializer:json"`
@@ -19,14 +94,91 @@ type Request struct {
 	Cookies    map[string]string   `gorm:"serializer:json"`
 	PostParams map[string][]string `gorm:"serializer:json"`
 	Body       string
+	Truncated  bool
 	Raw        string
+	Modified   bool   // changed by rewrite rules, Raw is what was sent
+	RawOrig    string // raw request before rewrite rules, empty if not modified
 }
 
 type Response struct {
 	StatusCode int                 `gorm:"column:Response_StatusCode"`
+	Proto      string              `gorm:"column:Response_Proto"`
 	Headers    map[string][]string `gorm:"serializer:json;column:Response_Headers"`
 	Cookies    map[string]string   `gorm:"serializer:json;column:Response_Cookies"`
 	PostParams map[string][]string `gorm:"serializer:json;column:Response_PostParams"`
 	Body       string              `gorm:"column:Response_Body"`
+	Truncated  bool                `gorm:"column:Response_Truncated"`
 	Raw        string              `gorm:"column:Response_Raw"`
+	Modified   bool                `gorm:"column:Response_Modified"`
+	RawOrig    string              `gorm:"column:Response_RawOrig"`
+}
+
+const (
+	FrameFromClient = "client"
+	FrameFromServer = "server"
+)
+
+type WebSocketFrame struct {
+	gorm.Model
+	RequestResponseID uint `gorm:"index"`
+	Direction         string
+	Fin               bool
+	Opcode            int
+	Length            int64
+	Payload           string
+	Truncated         bool
+	Timestamp         time.Time
+}
+
+const (
+	RewriteHeaderAdd     = "header_add"
+	RewriteHeaderRemove  = "header_remove"
+	RewriteHeaderReplace = "header_replace"
+	RewriteBody          = "body"
+	RewriteStatus        = "status"
+)
+
+// RewriteRule changes matching requests or responses in flight.
+type RewriteRule struct {
+	gorm.Model
+	Disabled bool   `json:"disabled"`
+	Stage    string `json:"stage"`            // request or response
+	Method   string `json:"method,omitempty"` // empty matches any
+	Host     string `json:"host,omitempty"`   // glob, e.g. *.example.com
+	Path     string `json:"path,omitempty"`   // regular expression
+	Type     string `json:"type"`
+	Header   string `json:"header,omitempty"` // header name for header_* types
+	Match    string `json:"match,omitempty"`  // regular expression, empty replaces the whole value
+	Replace  string `json:"replace,omitempty"`
+	Status   int    `json:"status,omitempty"`
+}
+
+// ScopeRule includes matching traffic into the project scope or excludes it.
+// Empty fields match anything.
+type ScopeRule struct {
+	gorm.Model
+	Exclude     bool   `json:"exclude"`
+	Scheme      string `json:"scheme,omitempty"`
+	Host        string `json:"host,omitempty"` // glob, e.g. *.example.com
+	Port        int    `json:"port,omitempty"`
+	Path        string `json:"path,omitempty"`         // regular expression
+	ContentType string `json:"content_type,omitempty"` // glob on response media type, e.g. image/*
+}
+
+const (
+	TunnelPassthrough = "passthrough" // host is in the passthrough list
+	TunnelRejected    = "rejected"    // client rejected the forged certificate before
+	TunnelRaw         = "raw"         // neither TLS nor HTTP
+)
+
+// Tunnel is a connection spliced to upstream without decryption, only its
+// metadata is known.
+type Tunnel struct {
+	gorm.Model
+	Host      string
+	Reason    string
+	BytesUp   int64 // from client to upstream
+	BytesDown int64
+	Started   time.Time
+	Duration  time.Duration
 }
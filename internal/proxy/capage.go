@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/pem"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/google/uuid"
+)
+
+// caPageTemplate is the page served on the magic hostname.
+var caPageTemplate = template.Must(template.New("ca").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>TrueProxy CA</title>
+<style>
+body { font-family: sans-serif; max-width: 720px; margin: 2em auto; padding: 0 1em; line-height: 1.5; }
+code { background: #eee; padding: 0 .3em; }
+</style>
+</head>
+<body>
+<h1>TrueProxy CA</h1>
+<p>Install this certificate authority to let the proxy intercept HTTPS traffic of this device.<br>
+<b>{{.Subject}}</b>, valid until {{.NotAfter}}</p>
+<ul>
+<li><a href="/cert/pem">TrueProxyCA.pem</a> – PEM</li>
+<li><a href="/cert/cer">TrueProxyCA.cer</a> – DER</li>
+<li><a href="/cert/mobileconfig">TrueProxyCA.mobileconfig</a> – Apple configuration profile</li>
+</ul>
+
+<h2>Android</h2>
+<p>Download the <a href="/cert/cer">.cer</a> file, then open Settings → Security → Encryption &amp; credentials → Install a certificate → CA certificate.
+Since Android 7 apps trust user CAs only if their network security config allows it.</p>
+
+<h2>iOS / iPadOS</h2>
+<p>Open the <a href="/cert/mobileconfig">.mobileconfig</a> in Safari and install the profile in Settings → General → VPN &amp; Device Management.
+Then enable full trust in Settings → General → About → Certificate Trust Settings.</p>
+
+<h2>macOS</h2>
+<p>Download the <a href="/cert/pem">.pem</a> file and run<br>
+<code>sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain TrueProxyCA.pem</code></p>
+
+<h2>Windows</h2>
+<p>Download the <a href="/cert/cer">.cer</a> file, open it and choose Install Certificate → Local Machine → Trusted Root Certification Authorities.
+Or run <code>certutil -addstore root TrueProxyCA.cer</code> as administrator.</p>
+
+<h2>Linux</h2>
+<p>Debian, Ubuntu: copy the <a href="/cert/pem">.pem</a> file to <code>/usr/local/share/ca-certificates/TrueProxyCA.crt</code> and run <code>sudo update-ca-certificates</code>.<br>
+Fedora, RHEL: copy it to <code>/etc/pki/ca-trust/source/anchors/</code> and run <code>sudo update-ca-trust</code>.</p>
+
+<h2>Firefox</h2>
+<p>Firefox keeps its own store: Settings → Privacy &amp; Security → Certificates → View Certificates → Authorities → Import, then trust it for websites.</p>
+</body>
+</html>
+`))
+
+var mobileconfigTemplate = texttemplate.Must(texttemplate.New("mobileconfig").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>TrueProxyCA.cer</string>
+			<key>PayloadContent</key>
+			<data>{{.Cert}}</data>
+			<key>PayloadDisplayName</key>
+			<string>{{html .Name}}</string>
+			<key>PayloadIdentifier</key>
+			<string>com.trueproxy.ca.{{.CertUUID}}</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>{{.CertUUID}}</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>{{html .Name}}</string>
+	<key>PayloadIdentifier</key>
+	<string>com.trueproxy.{{.UUID}}</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>{{.UUID}}</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`))
+
+// isCAPageHost reports whether the request is addressed to the magic
+// hostname answered by the proxy itself.
+func (p *ProxyHandler) isCAPageHost(r *http.Request) bool {
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	return p.caPageHost != "" && hostname(host) == p.caPageHost
+}
+
+// caPage answers requests to the magic hostname with the CA download page.
+// These requests never leave the proxy and are not stored.
+func (p *ProxyHandler) caPage(r *http.Request) *http.Response {
+	ca := p.cm.CA()
+
+	var body bytes.Buffer
+	var contentType, filename string
+	status := http.StatusOK
+
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "":
+		contentType = "text/html; charset=utf-8"
+		caPageTemplate.Execute(&body, struct {
+			Subject  string
+			NotAfter string
+		}{
+			Subject:  ca.Subject.String(),
+			NotAfter: ca.NotAfter.Format("2006-01-02"),
+		})
+	case "/cert/pem":
+		contentType, filename = "application/x-pem-file", "TrueProxyCA.pem"
+		pem.Encode(&body, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	case "/cert/cer":
+		contentType, filename = "application/pkix-cert", "TrueProxyCA.cer"
+		body.Write(ca.Raw)
+	case "/cert/mobileconfig":
+		contentType, filename = "application/x-apple-aspen-config", "TrueProxyCA.mobileconfig"
+		mobileconfigTemplate.Execute(&body, struct {
+			Cert     string
+			Name     string
+			UUID     string
+			CertUUID string
+		}{
+			Cert:     base64.StdEncoding.EncodeToString(ca.Raw),
+			Name:     ca.Subject.CommonName,
+			UUID:     uuid.NewSHA1(uuid.NameSpaceOID, ca.Raw).String(),
+			CertUUID: uuid.NewSHA1(uuid.NameSpaceX500, ca.Raw).String(),
+		})
+	default:
+		status = http.StatusNotFound
+		contentType = "text/plain; charset=utf-8"
+		body.WriteString("404 page not found\n")
+	}
+
+	resp := &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		ContentLength: int64(body.Len()),
+		Body:          io.NopCloser(&body),
+		Request:       r,
+	}
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Content-Length", strconv.Itoa(body.Len()))
+	resp.Header.Set("Cache-Control", "no-store")
+	if filename != "" {
+		resp.Header.Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	}
+	return resp
+}
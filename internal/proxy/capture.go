@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/url"
+	"sync"
+)
+
+// limitedBuffer keeps at most limit bytes written to it and silently
+// discards the rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+func (b *limitedBuffer) Truncated() bool {
+	return b.truncated
+}
+
+// captureBody passes a body through unchanged while keeping a copy of its
+// first bytes. onDone is called once, when the body is drained or closed.
+type captureBody struct {
+	rc     io.ReadCloser
+	onDone func(raw []byte, truncated bool)
+
+	mu   sync.Mutex
+	buf  limitedBuffer
+	once sync.Once
+}
+
+func newCaptureBody(rc io.ReadCloser, limit int, onDone func(raw []byte, truncated bool)) *captureBody {
+	return &captureBody{
+		rc:     rc,
+		onDone: onDone,
+		buf:    limitedBuffer{limit: limit},
+	}
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	if n > 0 {
+		b.mu.Lock()
+		b.buf.Write(p[:n])
+		b.mu.Unlock()
+	}
+	if err == io.EOF {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *captureBody) Close() error {
+	err := b.rc.Close()
+	b.done()
+	return err
+}
+
+// Captured returns the copy collected so far and whether it was cut by the limit.
+func (b *captureBody) Captured() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.Bytes()), b.buf.Truncated()
+}
+
+func (b *captureBody) done() {
+	b.once.Do(func() {
+		if b.onDone != nil {
+			b.onDone(b.Captured())
+		}
+	})
+}
+
+// decodeBody undoes content encoding of a captured body for storage.
+// A truncated gzip stream is decoded as far as possible.
+func decodeBody(contentEncoding string, raw []byte) string {
+	if contentEncoding != "gzip" || len(raw) == 0 {
+		return string(raw)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return string(raw)
+	}
+	defer reader.Close()
+
+	decoded, err := io.ReadAll(reader)
+	if err != nil && len(decoded) == 0 {
+		return string(raw)
+	}
+	return string(decoded)
+}
+
+func parsePostParams(contentType, body string) map[string][]string {
+	params := make(map[string][]string)
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return params
+	}
+	values, err := url.ParseQuery(body)
+	if err != nil {
+		return params
+	}
+	return values
+}
@@ -1,79 +1,89 @@
 package proxy
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"errors"
 	"math/big"
 	"net"
+	"strings"
 	"time"
 
+	"github.com/mrdjeb/trueproxy/internal/ca"
 	"github.com/mrdjeb/trueproxy/internal/config"
 )
 
 type CertManager struct {
 	ca           *x509.Certificate // Root certificate
-	caPrivateKey *rsa.PrivateKey   // CA private key
+	caPrivateKey crypto.Signer     // CA private key
 
 	roots *x509.CertPool
 
-	privateKey *rsa.PrivateKey
+	privateKey crypto.Signer // leaf key shared by forged certificates
 
 	validity     time.Duration
 	keyID        []byte
+	leafKey      string // leaf key type
+	perHost      bool   // fresh leaf key per certificate
 	organization string
-}
-
-func NewCertManager(cfg config.Cert) (*CertManager, error) {
+	mimic        bool
+	upstream     *Upstream // real servers are asked for certificates through it
 
-	tlsCert, err := tls.LoadX509KeyPair(cfg.CACertFile, cfg.CAKeyFile)
-	if err != nil {
-		return nil, err
-	}
+	cache *certCache // nil if caching is off
+}
 
-	privateKey, ok := tlsCert.PrivateKey.(*rsa.PrivateKey)
-	if !ok {
-		return nil, errors.New("failed cast caPrivateKey")
-	}
+// NewCertManager loads the CA from cfg. Upstream is used only to mimic
+// real server certificates.
+func NewCertManager(cfg config.Cert, upstream *Upstream) (*CertManager, error) {
 
-	ca, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	caCert, caPrivateKey, err := ca.Load(cfg)
 	if err != nil {
 		return nil, err
 	}
 
 	roots := x509.NewCertPool()
-	roots.AddCert(ca)
+	roots.AddCert(caCert)
 
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	priv, err := ca.GenerateKey(cfg.LeafKey)
 	if err != nil {
 		return nil, err
 	}
-	pub := priv.Public()
 
-	pkixpub, err := x509.MarshalPKIXPublicKey(pub)
+	keyID, err := subjectKeyID(priv.Public())
 	if err != nil {
 		return nil, err
 	}
-	h := sha1.New()
-	_, err = h.Write(pkixpub)
-	if err != nil {
-		return nil, err
-	}
-	keyID := h.Sum(nil)
 
-	return &CertManager{
-		ca:           ca,
-		caPrivateKey: privateKey,
+	c := &CertManager{
+		ca:           caCert,
+		caPrivateKey: caPrivateKey,
 		privateKey:   priv,
 		keyID:        keyID,
+		leafKey:      cfg.LeafKey,
+		perHost:      cfg.LeafPerHost,
 		validity:     time.Hour,
 		organization: cfg.Organization,
+		mimic:        cfg.Mimic,
+		upstream:     upstream,
 		roots:        roots,
-	}, nil
+	}
+	if cfg.CacheSize > 0 {
+		c.cache = newCertCache(cfg.CacheSize, c.validity/2)
+	}
+	return c, nil
+}
+
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	pkixpub, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	h := sha1.Sum(pkixpub)
+	return h[:], nil
 }
 
 func (c *CertManager) GenFakeCert(hostname string) (*tls.Certificate, error) {
@@ -83,8 +93,7 @@ func (c *CertManager) GenFakeCert(hostname string) (*tls.Certificate, error) {
 		hostname = host
 	}
 
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	serialNumber, err := newSerialNumber()
 	if err != nil {
 		return nil, err
 	}
@@ -95,7 +104,6 @@ func (c *CertManager) GenFakeCert(hostname string) (*tls.Certificate, error) {
 			CommonName:   hostname,
 			Organization: []string{c.organization},
 		},
-		SubjectKeyId:          c.keyID,
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
@@ -109,7 +117,30 @@ func (c *CertManager) GenFakeCert(hostname string) (*tls.Certificate, error) {
 		tmpl.DNSNames = []string{hostname}
 	}
 
-	raw, err := x509.CreateCertificate(rand.Reader, tmpl, c.ca, c.privateKey.Public(), c.caPrivateKey)
+	return c.sign(tmpl)
+}
+
+// sign issues a leaf certificate from tmpl with the CA, using the shared
+// leaf key or a fresh one per certificate.
+func (c *CertManager) sign(tmpl *x509.Certificate) (*tls.Certificate, error) {
+	key, keyID := c.privateKey, c.keyID
+	if c.perHost {
+		var err error
+		if key, err = ca.GenerateKey(c.leafKey); err != nil {
+			return nil, err
+		}
+		if keyID, err = subjectKeyID(key.Public()); err != nil {
+			return nil, err
+		}
+	}
+	tmpl.SubjectKeyId = keyID
+
+	// Key encipherment is meaningful for RSA keys only.
+	if _, ok := key.(*rsa.PrivateKey); !ok {
+		tmpl.KeyUsage &^= x509.KeyUsageKeyEncipherment
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, c.ca, key.Public(), c.caPrivateKey)
 	if err != nil {
 		return nil, err
 	}
@@ -121,24 +152,55 @@ func (c *CertManager) GenFakeCert(hostname string) (*tls.Certificate, error) {
 
 	cert := &tls.Certificate{
 		Certificate: [][]byte{raw, c.ca.Raw},
-		PrivateKey:  c.privateKey,
+		PrivateKey:  key,
 		Leaf:        x509c,
 	}
 
 	return cert, nil
+}
 
+func newSerialNumber() (*big.Int, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, serialNumberLimit)
+}
+
+// CA returns the certificate forged leafs are signed with.
+func (c *CertManager) CA() *x509.Certificate {
+	return c.ca
+}
+
+// Cert returns a forged certificate for hostname, from cache if possible.
+// With mimicking on, the real server at addr is asked for its certificate.
+func (c *CertManager) Cert(hostname, addr string) (*tls.Certificate, error) {
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
+	}
+
+	gen := c.GenFakeCert
+	if c.mimic {
+		gen = func(hostname string) (*tls.Certificate, error) {
+			return c.GenMimicCert(hostname, addr)
+		}
+	}
+
+	if c.cache == nil {
+		return gen(hostname)
+	}
+	return c.cache.get(strings.ToLower(hostname), gen)
 }
 
-func (c *CertManager) NewTLSConfig(hostname string) *tls.Config {
+// NewTLSConfig returns the client side config of a MITM tunnel to target
+// host:port, the certificate is forged for SNI or target host.
+func (c *CertManager) NewTLSConfig(target string) *tls.Config {
 	tlsConfig := &tls.Config{
 		GetCertificate: func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 			host := clientHello.ServerName
 			if host == "" {
-				host = hostname
+				host = target
 			}
-			return c.GenFakeCert(host)
+			return c.Cert(host, target)
 		},
-		NextProtos: []string{"http/1.1"},
+		NextProtos: []string{"h2", "http/1.1"},
 	}
 	tlsConfig.InsecureSkipVerify = true
 	return tlsConfig
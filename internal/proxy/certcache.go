@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/tls"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errCertPanic is what callers sharing a generation get when it panicked.
+var errCertPanic = errors.New("certificate generation panicked")
+
+// certCache is a bounded LRU of forged leaf certificates by hostname.
+// Concurrent misses for one hostname share a single generation.
+type certCache struct {
+	size    int
+	refresh time.Duration    // certificates generated longer ago are generated again
+	now     func() time.Time // replaced in tests
+
+	mu    sync.Mutex
+	ll    *list.List // front is the most recently used
+	items map[string]*list.Element
+	calls map[string]*certCall
+}
+
+type certEntry struct {
+	hostname string
+	cert     *tls.Certificate
+	added    time.Time // when cert was generated, mimics may copy any validity
+}
+
+type certCall struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+func newCertCache(size int, refresh time.Duration) *certCache {
+	return &certCache{
+		size:    size,
+		refresh: refresh,
+		now:     time.Now,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+		calls:   make(map[string]*certCall),
+	}
+}
+
+func (cc *certCache) get(hostname string, gen func(string) (*tls.Certificate, error)) (*tls.Certificate, error) {
+	cc.mu.Lock()
+	if el, ok := cc.items[hostname]; ok {
+		entry := el.Value.(*certEntry)
+		if cc.now().Sub(entry.added) < cc.refresh {
+			cc.ll.MoveToFront(el)
+			cc.mu.Unlock()
+			return entry.cert, nil
+		}
+		cc.ll.Remove(el)
+		delete(cc.items, hostname)
+	}
+	if call, ok := cc.calls[hostname]; ok {
+		cc.mu.Unlock()
+		<-call.done
+		return call.cert, call.err
+	}
+	call := &certCall{done: make(chan struct{})}
+	cc.calls[hostname] = call
+	cc.mu.Unlock()
+
+	cc.generate(hostname, call, gen)
+	return call.cert, call.err
+}
+
+// generate runs gen for the call, waiters are released even if gen panics.
+func (cc *certCache) generate(hostname string, call *certCall, gen func(string) (*tls.Certificate, error)) {
+	defer func() {
+		cc.mu.Lock()
+		delete(cc.calls, hostname)
+		if call.err == nil {
+			cc.add(hostname, call.cert)
+		}
+		cc.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.err = errCertPanic
+	call.cert, call.err = gen(hostname)
+}
+
+func (cc *certCache) add(hostname string, cert *tls.Certificate) {
+	if el, ok := cc.items[hostname]; ok {
+		entry := el.Value.(*certEntry)
+		entry.cert, entry.added = cert, cc.now()
+		cc.ll.MoveToFront(el)
+		return
+	}
+	cc.items[hostname] = cc.ll.PushFront(&certEntry{hostname: hostname, cert: cert, added: cc.now()})
+	for cc.ll.Len() > cc.size {
+		oldest := cc.ll.Back()
+		cc.ll.Remove(oldest)
+		delete(cc.items, oldest.Value.(*certEntry).hostname)
+	}
+}
@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mrdjeb/trueproxy/internal/ca"
+	"github.com/mrdjeb/trueproxy/internal/config"
+)
+
+// benchHosts is the number of distinct hostnames certificates are asked for.
+const benchHosts = 64
+
+var certBenchmarks = []struct {
+	name      string
+	cacheSize int
+}{
+	{"cache=off", 0},
+	{"cache=hit", benchHosts},       // every hostname stays cached
+	{"cache=evict", benchHosts / 4}, // LRU evicts most hostnames before reuse
+}
+
+func newBenchCertManager(b *testing.B, cacheSize int) *CertManager {
+	b.Helper()
+
+	dir := b.TempDir()
+	cfg := config.Cert{
+		CACertFile:   filepath.Join(dir, "ca.crt"),
+		CAKeyFile:    filepath.Join(dir, "ca.key"),
+		CAKeyType:    "rsa2048",
+		Organization: "TrueProxy",
+		CacheSize:    cacheSize,
+		LeafKey:      "rsa2048",
+	}
+	if err := ca.Init(cfg, ca.DefaultOptions(cfg), false); err != nil {
+		b.Fatal(err)
+	}
+	cm, err := NewCertManager(cfg, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return cm
+}
+
+func benchHostname(i int) string {
+	return fmt.Sprintf("host%d.example.com", i%benchHosts)
+}
+
+func BenchmarkCertManagerCert(b *testing.B) {
+	for _, bm := range certBenchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			cm := newBenchCertManager(b, bm.cacheSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := cm.Cert(benchHostname(i), ""); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCertManagerCertParallel asks for the same hostnames from many
+// goroutines, concurrent misses share one generation.
+func BenchmarkCertManagerCertParallel(b *testing.B) {
+	for _, bm := range certBenchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			cm := newBenchCertManager(b, bm.cacheSize)
+			var next atomic.Int64
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := int(next.Add(1) / 4) // neighbours ask for the same hostname
+					if _, err := cm.Cert(benchHostname(i), ""); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// testClock is a settable certCache clock.
+type testClock struct{ now time.Time }
+
+func (c *testClock) Now() time.Time { return c.now }
+
+func TestCertCacheGet(t *testing.T) {
+	type step struct {
+		hostname string
+		after    time.Duration // clock advance before the call
+		fail     bool          // generation returns an error
+		gen      bool          // generation is expected
+	}
+
+	tests := []struct {
+		name  string
+		size  int
+		steps []step
+	}{
+		{
+			name: "hit",
+			size: 2,
+			steps: []step{
+				{hostname: "a", gen: true},
+				{hostname: "a"},
+				{hostname: "b", gen: true},
+				{hostname: "a"},
+				{hostname: "b"},
+			},
+		},
+		{
+			name: "LRU eviction at size",
+			size: 2,
+			steps: []step{
+				{hostname: "a", gen: true},
+				{hostname: "b", gen: true},
+				{hostname: "a"},
+				{hostname: "c", gen: true}, // evicts b, least recently used
+				{hostname: "a"},
+				{hostname: "c"},
+				{hostname: "b", gen: true}, // evicts a
+				{hostname: "a", gen: true},
+			},
+		},
+		{
+			name: "refresh by generation time",
+			size: 2,
+			steps: []step{
+				{hostname: "a", gen: true},
+				{hostname: "a", after: 29 * time.Minute},
+				{hostname: "a", after: time.Minute, gen: true},
+				{hostname: "a", after: 29 * time.Minute},
+			},
+		},
+		{
+			name: "errors are not cached",
+			size: 2,
+			steps: []step{
+				{hostname: "a", fail: true, gen: true},
+				{hostname: "a", fail: true, gen: true},
+				{hostname: "a", gen: true},
+				{hostname: "a"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &testClock{now: time.Now()}
+			cc := newCertCache(tt.size, 30*time.Minute)
+			cc.now = clock.Now
+			errGen := errors.New("gen failed")
+			last := map[string]*tls.Certificate{}
+
+			for i, s := range tt.steps {
+				clock.now = clock.now.Add(s.after)
+				generated := false
+				cert, err := cc.get(s.hostname, func(string) (*tls.Certificate, error) {
+					generated = true
+					if s.fail {
+						return nil, errGen
+					}
+					return &tls.Certificate{}, nil
+				})
+
+				if generated != s.gen {
+					t.Fatalf("step %d %s: generated %v, want %v", i, s.hostname, generated, s.gen)
+				}
+				if s.fail {
+					if !errors.Is(err, errGen) {
+						t.Fatalf("step %d %s: err %v, want %v", i, s.hostname, err, errGen)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("step %d %s: %v", i, s.hostname, err)
+				}
+				if !s.gen && cert != last[s.hostname] {
+					t.Fatalf("step %d %s: cached certificate is not returned", i, s.hostname)
+				}
+				last[s.hostname] = cert
+			}
+			if cc.ll.Len() > tt.size || len(cc.items) != cc.ll.Len() || len(cc.calls) != 0 {
+				t.Fatalf("cache state: %d listed, %d indexed, %d calls", cc.ll.Len(), len(cc.items), len(cc.calls))
+			}
+		})
+	}
+}
+
+func TestCertCacheGetShared(t *testing.T) {
+	const callers = 8
+
+	cc := newCertCache(2, 30*time.Minute)
+	started, release := make(chan struct{}), make(chan struct{})
+	var gens atomic.Int32
+	gen := func(string) (*tls.Certificate, error) {
+		if gens.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return &tls.Certificate{}, nil
+	}
+
+	certs := make(chan *tls.Certificate, callers)
+	get := func() {
+		cert, err := cc.get("a", gen)
+		if err != nil {
+			t.Error(err)
+		}
+		certs <- cert
+	}
+	go get()
+	<-started
+	for i := 1; i < callers; i++ {
+		go get()
+	}
+	close(release)
+
+	first := <-certs
+	for i := 1; i < callers; i++ {
+		if cert := <-certs; cert != first {
+			t.Fatal("callers got different certificates")
+		}
+	}
+	if n := gens.Load(); n != 1 {
+		t.Fatalf("generated %d times, want 1", n)
+	}
+}
+
+func TestCertCacheGetPanic(t *testing.T) {
+	cc := newCertCache(2, 30*time.Minute)
+	started, release := make(chan struct{}), make(chan struct{})
+
+	go func() {
+		defer func() { recover() }()
+		cc.get("a", func(string) (*tls.Certificate, error) {
+			close(started)
+			<-release
+			panic("gen")
+		})
+	}()
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		// Joins the panicking generation, or runs its own once it is gone.
+		_, err := cc.get("a", func(string) (*tls.Certificate, error) {
+			return &tls.Certificate{}, nil
+		})
+		done <- err
+	}()
+	close(release)
+
+	select {
+	case err := <-done:
+		if err != nil && !errors.Is(err, errCertPanic) {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter is not released after a panic in generation")
+	}
+}
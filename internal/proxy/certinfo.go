@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+
+	"github.com/mrdjeb/trueproxy/internal/models"
+)
+
+var keyUsageNames = []struct {
+	usage x509.KeyUsage
+	name  string
+}{
+	{x509.KeyUsageDigitalSignature, "DigitalSignature"},
+	{x509.KeyUsageContentCommitment, "ContentCommitment"},
+	{x509.KeyUsageKeyEncipherment, "KeyEncipherment"},
+	{x509.KeyUsageDataEncipherment, "DataEncipherment"},
+	{x509.KeyUsageKeyAgreement, "KeyAgreement"},
+	{x509.KeyUsageCertSign, "CertSign"},
+	{x509.KeyUsageCRLSign, "CRLSign"},
+	{x509.KeyUsageEncipherOnly, "EncipherOnly"},
+	{x509.KeyUsageDecipherOnly, "DecipherOnly"},
+}
+
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "Any",
+	x509.ExtKeyUsageServerAuth:      "ServerAuth",
+	x509.ExtKeyUsageClientAuth:      "ClientAuth",
+	x509.ExtKeyUsageCodeSigning:     "CodeSigning",
+	x509.ExtKeyUsageEmailProtection: "EmailProtection",
+	x509.ExtKeyUsageTimeStamping:    "TimeStamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSPSigning",
+}
+
+// certChain describes certificates for storage.
+func certChain(certs []*x509.Certificate) []models.CertInfo {
+	if len(certs) == 0 {
+		return nil
+	}
+
+	chain := make([]models.CertInfo, 0, len(certs))
+	for _, cert := range certs {
+		fingerprint := sha256.Sum256(cert.Raw)
+		info := models.CertInfo{
+			Subject:            cert.Subject.String(),
+			Issuer:             cert.Issuer.String(),
+			SerialNumber:       cert.SerialNumber.Text(16),
+			NotBefore:          cert.NotBefore,
+			NotAfter:           cert.NotAfter,
+			DNSNames:           cert.DNSNames,
+			SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+			PublicKeyAlgorithm: cert.PublicKeyAlgorithm.String(),
+			SHA256:             hex.EncodeToString(fingerprint[:]),
+			IsCA:               cert.IsCA,
+		}
+		for _, ip := range cert.IPAddresses {
+			info.IPAddresses = append(info.IPAddresses, ip.String())
+		}
+		for _, ku := range keyUsageNames {
+			if cert.KeyUsage&ku.usage != 0 {
+				info.KeyUsage = append(info.KeyUsage, ku.name)
+			}
+		}
+		for _, eku := range cert.ExtKeyUsage {
+			if name, ok := extKeyUsageNames[eku]; ok {
+				info.ExtKeyUsage = append(info.ExtKeyUsage, name)
+			}
+		}
+		chain = append(chain, info)
+	}
+	return chain
+}
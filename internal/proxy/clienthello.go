@@ -0,0 +1,382 @@
+package proxy
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+
+	"github.com/mrdjeb/trueproxy/internal/models"
+)
+
+const (
+	maxHelloSize = 64 << 10
+
+	extServerName          = 0x0000
+	extSupportedGroups     = 0x000a
+	extECPointFormats      = 0x000b
+	extSignatureAlgorithms = 0x000d
+	extALPN                = 0x0010
+	extSupportedVersions   = 0x002b
+)
+
+var errShortHello = errors.New("incomplete ClientHello")
+
+type clientHelloKey struct{}
+
+func withClientHello(ctx context.Context, hello *models.ClientHello) context.Context {
+	return context.WithValue(ctx, clientHelloKey{}, hello)
+}
+
+func clientHelloFrom(ctx context.Context) *models.ClientHello {
+	hello, _ := ctx.Value(clientHelloKey{}).(*models.ClientHello)
+	return hello
+}
+
+// helloConn keeps a copy of what the client sends until the handshake is
+// over, the ClientHello is parsed from it.
+type helloConn struct {
+	net.Conn
+	buf       []byte
+	recording bool
+}
+
+func newHelloConn(conn net.Conn) *helloConn {
+	return &helloConn{Conn: conn, recording: true}
+}
+
+func (c *helloConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.recording {
+		if len(c.buf)+n > maxHelloSize {
+			c.recording = false
+		} else {
+			c.buf = append(c.buf, p[:n]...)
+		}
+	}
+	return n, err
+}
+
+// clientHello stops recording and parses the recorded ClientHello.
+func (c *helloConn) clientHello() (*models.ClientHello, error) {
+	c.recording = false
+	buf := c.buf
+	c.buf = nil
+	return parseClientHello(buf)
+}
+
+// rawHello holds ClientHello fields in wire order.
+type rawHello struct {
+	version      uint16
+	ciphers      []uint16
+	extensions   []uint16
+	serverName   string
+	alpn         []string
+	groups       []uint16
+	pointFormats []uint8
+	sigAlgs      []uint16
+	versions     []uint16
+}
+
+// parseClientHello reads the first handshake message from TLS records.
+func parseClientHello(data []byte) (*models.ClientHello, error) {
+	// The handshake message may span several records.
+	var msg []byte
+	for {
+		if len(data) < 5 || data[0] != recordTypeHandshake {
+			return nil, errShortHello
+		}
+		n := int(data[3])<<8 | int(data[4])
+		if len(data) < 5+n {
+			return nil, errShortHello
+		}
+		msg = append(msg, data[5:5+n]...)
+		data = data[5+n:]
+		if len(msg) >= 4 && len(msg) >= 4+(int(msg[1])<<16|int(msg[2])<<8|int(msg[3])) {
+			break
+		}
+	}
+
+	hello, err := parseHelloMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	return hello.describe(), nil
+}
+
+func parseHelloMessage(msg []byte) (*rawHello, error) {
+	s := cryptobyte.String(msg)
+	var msgType uint8
+	var body cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != 1 || !s.ReadUint24LengthPrefixed(&body) {
+		return nil, errors.New("not a ClientHello")
+	}
+
+	h := &rawHello{}
+	var sessionID, ciphers, compression cryptobyte.String
+	if !body.ReadUint16(&h.version) ||
+		!body.Skip(32) || // random
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&ciphers) ||
+		!body.ReadUint8LengthPrefixed(&compression) {
+		return nil, errors.New("malformed ClientHello")
+	}
+	for !ciphers.Empty() {
+		var c uint16
+		if !ciphers.ReadUint16(&c) {
+			return nil, errors.New("malformed cipher suites")
+		}
+		h.ciphers = append(h.ciphers, c)
+	}
+	if body.Empty() {
+		return h, nil
+	}
+
+	var exts cryptobyte.String
+	if !body.ReadUint16LengthPrefixed(&exts) {
+		return nil, errors.New("malformed extensions")
+	}
+	for !exts.Empty() {
+		var typ uint16
+		var data cryptobyte.String
+		if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&data) {
+			return nil, errors.New("malformed extensions")
+		}
+		h.extensions = append(h.extensions, typ)
+		if err := h.parseExtension(typ, data); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (h *rawHello) parseExtension(typ uint16, data cryptobyte.String) error {
+	var list cryptobyte.String
+	switch typ {
+	case extServerName:
+		if !data.ReadUint16LengthPrefixed(&list) {
+			return errors.New("malformed server_name")
+		}
+		for !list.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !list.ReadUint8(&nameType) || !list.ReadUint16LengthPrefixed(&name) {
+				return errors.New("malformed server_name")
+			}
+			if nameType == 0 {
+				h.serverName = string(name)
+			}
+		}
+	case extALPN:
+		if !data.ReadUint16LengthPrefixed(&list) {
+			return errors.New("malformed ALPN")
+		}
+		for !list.Empty() {
+			var proto cryptobyte.String
+			if !list.ReadUint8LengthPrefixed(&proto) {
+				return errors.New("malformed ALPN")
+			}
+			h.alpn = append(h.alpn, string(proto))
+		}
+	case extSupportedGroups, extSignatureAlgorithms:
+		if !data.ReadUint16LengthPrefixed(&list) {
+			return fmt.Errorf("malformed extension %d", typ)
+		}
+		values, ok := readUint16s(list)
+		if !ok {
+			return fmt.Errorf("malformed extension %d", typ)
+		}
+		if typ == extSupportedGroups {
+			h.groups = values
+		} else {
+			h.sigAlgs = values
+		}
+	case extSupportedVersions:
+		if !data.ReadUint8LengthPrefixed(&list) {
+			return errors.New("malformed supported_versions")
+		}
+		values, ok := readUint16s(list)
+		if !ok {
+			return errors.New("malformed supported_versions")
+		}
+		h.versions = values
+	case extECPointFormats:
+		if !data.ReadUint8LengthPrefixed(&list) {
+			return errors.New("malformed ec_point_formats")
+		}
+		h.pointFormats = list
+	}
+	return nil
+}
+
+func readUint16s(s cryptobyte.String) ([]uint16, bool) {
+	var values []uint16
+	for !s.Empty() {
+		var v uint16
+		if !s.ReadUint16(&v) {
+			return nil, false
+		}
+		values = append(values, v)
+	}
+	return values, true
+}
+
+// isGREASE reports whether v is one of the reserved values clients send to
+// keep servers tolerant (RFC 8701), fingerprints ignore them.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func (h *rawHello) describe() *models.ClientHello {
+	hello := &models.ClientHello{
+		SNI:  h.serverName,
+		ALPN: h.alpn,
+		JA4:  h.ja4(),
+	}
+
+	versions := withoutGREASE(h.versions)
+	if len(versions) == 0 {
+		versions = []uint16{h.version}
+	}
+	for _, v := range versions {
+		hello.Versions = append(hello.Versions, tls.VersionName(v))
+	}
+	for _, c := range withoutGREASE(h.ciphers) {
+		hello.CipherSuites = append(hello.CipherSuites, tls.CipherSuiteName(c))
+	}
+
+	hello.JA3 = h.ja3()
+	sum := md5.Sum([]byte(hello.JA3))
+	hello.JA3Hash = hex.EncodeToString(sum[:])
+	return hello
+}
+
+// ja3 is "version,ciphers,extensions,groups,point formats" in decimal.
+func (h *rawHello) ja3() string {
+	formats := make([]uint16, len(h.pointFormats))
+	for i, f := range h.pointFormats {
+		formats[i] = uint16(f)
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		joinDecimal(withoutGREASE(h.ciphers)),
+		joinDecimal(withoutGREASE(h.extensions)),
+		joinDecimal(withoutGREASE(h.groups)),
+		joinDecimal(formats),
+	}, ",")
+}
+
+// ja4 is the JA4 TLS client fingerprint, e.g. t13d1516h2_8daaf6152771_e5627efa2ab1.
+func (h *rawHello) ja4() string {
+	ciphers := withoutGREASE(h.ciphers)
+	extensions := withoutGREASE(h.extensions)
+
+	version := h.version
+	for _, v := range withoutGREASE(h.versions) {
+		if v > version {
+			version = v
+		}
+	}
+
+	sni := "i"
+	if h.serverName != "" {
+		sni = "d"
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(version), sni,
+		min(len(ciphers), 99), min(len(extensions), 99), ja4ALPN(h.alpn))
+
+	sortedCiphers := append([]uint16(nil), ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+
+	var sortedExts []uint16
+	for _, e := range extensions {
+		if e != extServerName && e != extALPN {
+			sortedExts = append(sortedExts, e)
+		}
+	}
+	sort.Slice(sortedExts, func(i, j int) bool { return sortedExts[i] < sortedExts[j] })
+
+	c := joinHex(sortedExts)
+	if len(h.sigAlgs) > 0 {
+		c += "_" + joinHex(withoutGREASE(h.sigAlgs))
+	}
+
+	return a + "_" + ja4Hash(joinHex(sortedCiphers), len(sortedCiphers)) + "_" + ja4Hash(c, len(sortedExts))
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+// ja4ALPN is the first and last character of the first offered protocol.
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	first, last := alpn[0][0], alpn[0][len(alpn[0])-1]
+	if !isAlnum(first) || !isAlnum(last) {
+		h := hex.EncodeToString([]byte(alpn[0]))
+		return h[:1] + h[len(h)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+func isAlnum(b byte) bool {
+	return '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+func ja4Hash(s string, count int) string {
+	if count == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
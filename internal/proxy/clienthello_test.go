@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"slices"
+	"testing"
+)
+
+// chromeHello is a ClientHello of Chrome to example.com, its JA3 and JA4
+// are the published ones of Chrome. It offers GREASE values in ciphers,
+// extensions, groups, key shares and supported versions, and TLS 1.3 only
+// in supported_versions.
+const chromeHello = "1603010148010001440303000102030405060708090a0b0c0d0e0f1011121314" +
+	"15161718191a1b1c1d1e1f20202122232425262728292a2b2c2d2e2f30313233" +
+	"3435363738393a3b3c3d3e3f00200a0a130113021303c02bc02fc02cc030cca9" +
+	"cca8c013c014009c009d002f0035010000db1a1a000000000010000e00000b65" +
+	"78616d706c652e636f6d00170000ff01000100000a000a00083a3a001d001700" +
+	"18000b00020100002300000010000e000c02683208687474702f312e31000500" +
+	"050100000000000d001200100403080404010503080505010806060100120000" +
+	"0033002b00293a3a000100001d0020000102030405060708090a0b0c0d0e0f10" +
+	"1112131415161718191a1b1c1d1e1f002d00020101002b0007064a4a03040303" +
+	"001b00030200024469000500030268322a2a0001000015001400000000000000" +
+	"00000000000000000000000000"
+
+// tls12Hello offers two TLS 1.2 ciphers without SNI, ALPN and
+// supported_versions.
+const tls12Hello = "160301003e0100003a0303000000000000000000000000000000000000000000" +
+	"0000000000000000000000000004c02fc0300100000d000d000400020401ff01" +
+	"000100"
+
+// splitRecord moves the handshake message of a single record into records
+// of at most n bytes.
+func splitRecord(record []byte, n int) []byte {
+	var out []byte
+	for msg := record[5:]; len(msg) > 0; {
+		chunk := msg[:min(n, len(msg))]
+		msg = msg[len(chunk):]
+		out = append(out, record[0], record[1], record[2], byte(len(chunk)>>8), byte(len(chunk)))
+		out = append(out, chunk...)
+	}
+	return out
+}
+
+func TestParseClientHello(t *testing.T) {
+	chrome, _ := hex.DecodeString(chromeHello)
+	tls12, _ := hex.DecodeString(tls12Hello)
+
+	chromeJA3 := "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+		"0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0"
+
+	tests := []struct {
+		name     string
+		data     []byte
+		sni      string
+		alpn     []string
+		versions []string
+		ciphers  int
+		ja3      string
+		ja3Hash  string
+		ja4      string
+	}{
+		{
+			name:     "chrome",
+			data:     chrome,
+			sni:      "example.com",
+			alpn:     []string{"h2", "http/1.1"},
+			versions: []string{"TLS 1.3", "TLS 1.2"},
+			ciphers:  15,
+			ja3:      chromeJA3,
+			ja3Hash:  "cd08e31494f9531f560d64c695473da9",
+			// JA4_c hashes the sorted extensions without SNI and ALPN.
+			ja4: "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name:     "chrome in several records",
+			data:     splitRecord(chrome, 100),
+			sni:      "example.com",
+			alpn:     []string{"h2", "http/1.1"},
+			versions: []string{"TLS 1.3", "TLS 1.2"},
+			ciphers:  15,
+			ja3:      chromeJA3,
+			ja3Hash:  "cd08e31494f9531f560d64c695473da9",
+			ja4:      "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name:     "TLS 1.2 without SNI and ALPN",
+			data:     tls12,
+			versions: []string{"TLS 1.2"},
+			ciphers:  2,
+			ja3:      "771,49199-49200,13-65281,,",
+			ja3Hash:  "1c6375f7b2837d46e7e375de6772ed8a",
+			ja4:      "t12i020200_04659ec43a24_fc8676163746",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello, err := parseClientHello(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hello.SNI != tt.sni {
+				t.Errorf("SNI %q, want %q", hello.SNI, tt.sni)
+			}
+			if !slices.Equal(hello.ALPN, tt.alpn) {
+				t.Errorf("ALPN %q, want %q", hello.ALPN, tt.alpn)
+			}
+			if !slices.Equal(hello.Versions, tt.versions) {
+				t.Errorf("versions %q, want %q", hello.Versions, tt.versions)
+			}
+			if len(hello.CipherSuites) != tt.ciphers {
+				t.Errorf("%d cipher suites, want %d", len(hello.CipherSuites), tt.ciphers)
+			}
+			if hello.JA3 != tt.ja3 {
+				t.Errorf("JA3 %q, want %q", hello.JA3, tt.ja3)
+			}
+			if hello.JA3Hash != tt.ja3Hash {
+				t.Errorf("JA3 hash %s, want %s", hello.JA3Hash, tt.ja3Hash)
+			}
+			if hello.JA4 != tt.ja4 {
+				t.Errorf("JA4 %s, want %s", hello.JA4, tt.ja4)
+			}
+		})
+	}
+}
+
+func TestParseClientHelloShort(t *testing.T) {
+	chrome, _ := hex.DecodeString(chromeHello)
+	for _, n := range []int{0, 4, 5, 100, len(chrome) - 1} {
+		if _, err := parseClientHello(chrome[:n]); err != errShortHello {
+			t.Errorf("%d bytes: err %v, want %v", n, err, errShortHello)
+		}
+	}
+}
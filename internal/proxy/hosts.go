@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// hostOverride connects hosts matching pattern to addr instead of the
+// address they resolve to.
+type hostOverride struct {
+	pattern string
+	addr    string // host or host:port, the port of the request is kept if missing
+}
+
+// hostOverrides is a built-in hosts file, the first matching pattern wins.
+type hostOverrides []hostOverride
+
+// parseHostOverrides reads "pattern=address" entries like
+// "api.example.com=127.0.0.1:8080" or "*.dev.local=10.0.0.5".
+func parseHostOverrides(entries []string) (hostOverrides, error) {
+	var overrides hostOverrides
+	for _, entry := range entries {
+		pattern, addr, ok := strings.Cut(entry, "=")
+		pattern, addr = strings.TrimSpace(pattern), strings.TrimSpace(addr)
+		if !ok || pattern == "" || addr == "" {
+			return nil, fmt.Errorf("bad host override %q, want pattern=address", entry)
+		}
+		overrides = append(overrides, hostOverride{pattern: pattern, addr: addr})
+	}
+	return overrides, nil
+}
+
+// match reports whether host is overridden.
+func (o hostOverrides) match(host string) bool {
+	for _, override := range o {
+		if matchHost([]string{override.pattern}, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the address to connect to instead of addr host:port.
+func (o hostOverrides) lookup(addr string) (string, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", false
+	}
+	for _, override := range o {
+		if !matchHost([]string{override.pattern}, host) {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(override.addr); err == nil {
+			return override.addr, true
+		}
+		return net.JoinHostPort(override.addr, port), true
+	}
+	return "", false
+}
+
+// dialer wraps dial to connect overridden hosts to their address. Host
+// header and SNI stay those of the request.
+func (o hostOverrides) dialer(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if override, ok := o.lookup(addr); ok {
+			addr = override
+		}
+		return dial(ctx, network, addr)
+	}
+}
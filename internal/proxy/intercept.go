@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+
+	"github.com/mrdjeb/trueproxy/internal/intercept"
+)
+
+// holdRequest pauses a request matching a breakpoint rule until it is
+// forwarded, edited or dropped through the API.
+func (rt proxyRoundTripper) holdRequest(r *http.Request) (*http.Request, error) {
+	if rt.queue == nil {
+		return r, nil
+	}
+	rule, ok := rt.queue.Match(intercept.StageRequest, r.Method, r.URL.Hostname(), r.URL.Path)
+	if !ok {
+		return r, nil
+	}
+
+	withBody := rt.holdsBody(r.ContentLength, r.Header)
+	raw, err := httputil.DumpRequest(r, withBody)
+	if err != nil {
+		return nil, err
+	}
+
+	decision := rt.queue.Hold(r.Context(), rule, intercept.Item{
+		Stage:       intercept.StageRequest,
+		Method:      r.Method,
+		Host:        r.URL.Host,
+		Path:        r.URL.Path,
+		Raw:         string(raw),
+		BodyOmitted: !withBody,
+	})
+	if decision.Action == intercept.ActionDrop {
+		return nil, intercept.ErrDropped
+	}
+	if decision.Raw == "" {
+		return r, nil
+	}
+
+	edited, err := parseRawRequest(decision.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("bad edited request: %w", err)
+	}
+	if !withBody {
+		edited.Body, edited.ContentLength, edited.TransferEncoding = r.Body, r.ContentLength, r.TransferEncoding
+		keepFraming(edited.Header, r.ContentLength)
+	}
+	edited.URL.Scheme = r.URL.Scheme
+	edited.URL.Host = edited.Host
+	if edited.URL.Host == "" {
+		edited.URL.Host, edited.Host = r.URL.Host, r.Host
+	}
+	return edited.WithContext(r.Context()), nil
+}
+
+// holdResponse is holdRequest for the upstream response. Timer of the
+// exchange is paused while the response is held.
+func (rt proxyRoundTripper) holdResponse(r *http.Request, resp *http.Response, timer *exchangeTimer) (*http.Response, error) {
+	if rt.queue == nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp, nil
+	}
+	rule, ok := rt.queue.Match(intercept.StageResponse, r.Method, r.URL.Hostname(), r.URL.Path)
+	if !ok {
+		return resp, nil
+	}
+
+	withBody := rt.holdsBody(resp.ContentLength, resp.Header)
+	raw, err := httputil.DumpResponse(resp, withBody)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	timer.pause()
+	decision := rt.queue.Hold(r.Context(), rule, intercept.Item{
+		Stage:       intercept.StageResponse,
+		Method:      r.Method,
+		Host:        r.URL.Host,
+		Path:        r.URL.Path,
+		Raw:         string(raw),
+		BodyOmitted: !withBody,
+	})
+	timer.resume()
+	if decision.Action == intercept.ActionDrop {
+		resp.Body.Close()
+		return nil, intercept.ErrDropped
+	}
+	if decision.Raw == "" {
+		return resp, nil
+	}
+
+	edited, err := parseRawResponse(decision.Raw, r)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("bad edited response: %w", err)
+	}
+	if withBody {
+		resp.Body.Close()
+	} else {
+		edited.Body, edited.ContentLength, edited.TransferEncoding = resp.Body, resp.ContentLength, resp.TransferEncoding
+		keepFraming(edited.Header, resp.ContentLength)
+	}
+	edited.TLS = resp.TLS
+	return edited, nil
+}
+
+// holdsBody reports whether a message is held with its body. Streams and
+// bodies of unknown length or over the capture limit are held by head
+// only, the body is forwarded untouched once the head is released.
+func (rt proxyRoundTripper) holdsBody(contentLength int64, header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return contentLength >= 0 && contentLength <= int64(rt.bodyLimit) && mediaType != "text/event-stream"
+}
+
+// keepFraming makes an edited head describe the original body it is sent
+// with.
+func keepFraming(header http.Header, contentLength int64) {
+	header.Del("Transfer-Encoding")
+	if contentLength >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	} else {
+		header.Del("Content-Length")
+	}
+}
+
+// splitRaw separates head and body of a hand edited HTTP message, so body
+// length never depends on a stale Content-Length header.
+func splitRaw(raw string) (string, string) {
+	if i := strings.Index(raw, "\r\n\r\n"); i >= 0 {
+		return raw[:i+2], raw[i+4:]
+	}
+	if i := strings.Index(raw, "\n\n"); i >= 0 {
+		return raw[:i+1], raw[i+2:]
+	}
+	return raw, ""
+}
+
+func rawBody(transferEncoding []string, body string) ([]byte, error) {
+	if len(transferEncoding) > 0 && transferEncoding[0] == "chunked" {
+		return io.ReadAll(httputil.NewChunkedReader(strings.NewReader(body)))
+	}
+	return []byte(body), nil
+}
+
+func parseRawRequest(raw string) (*http.Request, error) {
+	head, body := splitRaw(raw)
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(head + "\r\n")))
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := rawBody(r.TransferEncoding, body)
+	if err != nil {
+		return nil, err
+	}
+	r.RequestURI = ""
+	r.TransferEncoding = nil
+	r.Header.Del("Transfer-Encoding")
+	r.ContentLength = int64(len(b))
+	r.Body = http.NoBody
+	if len(b) > 0 {
+		r.Header.Set("Content-Length", strconv.Itoa(len(b)))
+		r.Body = io.NopCloser(bytes.NewReader(b))
+	}
+	return r, nil
+}
+
+func parseRawResponse(raw string, r *http.Request) (*http.Response, error) {
+	head, body := splitRaw(raw)
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(head+"\r\n")), r)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := rawBody(resp.TransferEncoding, body)
+	if err != nil {
+		return nil, err
+	}
+	resp.TransferEncoding = nil
+	resp.Header.Del("Transfer-Encoding")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(b)))
+	resp.ContentLength = int64(len(b))
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	return resp, nil
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"time"
+)
+
+const mimicTimeout = 10 * time.Second
+
+// upstreamCert fetches the leaf certificate the real server at addr presents
+// for hostname, connecting the way proxied traffic does. It is not
+// verified, invalid certificates are mimicked too.
+func upstreamCert(upstream *Upstream, hostname, addr string) (*x509.Certificate, error) {
+	if addr == "" {
+		addr = hostname
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mimicTimeout)
+	defer cancel()
+
+	rawConn, err := upstream.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer rawConn.Close()
+
+	tlsConfig := upstream.TLSConfig(hostname)
+	if tlsConfig.ServerName == "" && net.ParseIP(hostname) == nil {
+		tlsConfig.ServerName = hostname
+	}
+	tlsConfig.InsecureSkipVerify = true
+	conn := tls.Client(rawConn, tlsConfig)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("no upstream certificate")
+	}
+	return certs[0], nil
+}
+
+// GenMimicCert forges a certificate for hostname copying subject, SANs, key
+// usage and validity of the real server certificate. It falls back to
+// GenFakeCert if the server is not reachable.
+func (c *CertManager) GenMimicCert(hostname, addr string) (*tls.Certificate, error) {
+	upstream, err := upstreamCert(c.upstream, hostname, addr)
+	if err != nil {
+		return c.GenFakeCert(hostname)
+	}
+
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               upstream.Subject,
+		DNSNames:              upstream.DNSNames,
+		IPAddresses:           upstream.IPAddresses,
+		EmailAddresses:        upstream.EmailAddresses,
+		URIs:                  upstream.URIs,
+		KeyUsage:              upstream.KeyUsage,
+		ExtKeyUsage:           upstream.ExtKeyUsage,
+		BasicConstraintsValid: true,
+		NotBefore:             upstream.NotBefore,
+		NotAfter:              upstream.NotAfter,
+	}
+
+	// Keep the tunnel working when the server answers with a certificate
+	// for another name.
+	if upstream.VerifyHostname(hostname) != nil {
+		if ip := net.ParseIP(hostname); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, hostname)
+		}
+	}
+
+	return c.sign(tmpl)
+}
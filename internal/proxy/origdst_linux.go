@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ip6tSoOriginalDst is IP6T_SO_ORIGINAL_DST from
+// linux/netfilter_ipv6/ip6_tables.h, the IPv6 twin of SO_ORIGINAL_DST.
+const ip6tSoOriginalDst = 80
+
+// originalDst returns the destination of a connection before it was
+// rewritten by an iptables REDIRECT rule.
+func originalDst(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("not a tcp connection")
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	local, _ := tcpConn.LocalAddr().(*net.TCPAddr)
+	isIPv4 := local != nil && local.IP.To4() != nil
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if isIPv4 {
+			var sa unix.RawSockaddrInet4
+			sockErr = getsockopt(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST, unsafe.Pointer(&sa), unix.SizeofSockaddrInet4)
+			addr = &net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: int(networkPort(sa.Port))}
+			return
+		}
+		var sa unix.RawSockaddrInet6
+		sockErr = getsockopt(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst, unsafe.Pointer(&sa), unix.SizeofSockaddrInet6)
+		addr = &net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: int(networkPort(sa.Port))}
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", sockErr
+	}
+
+	return net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port)), nil
+}
+
+// getsockopt reads a size bytes long option into val.
+func getsockopt(fd, level, opt int, val unsafe.Pointer, size uint32) error {
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt),
+		uintptr(val), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// networkPort converts a sockaddr port, stored in network byte order, to
+// its value.
+func networkPort(port uint16) uint16 {
+	var raw [2]byte
+	binary.NativeEndian.PutUint16(raw[:], port)
+	return binary.BigEndian.Uint16(raw[:])
+}
+
+// ListenTransparent listens on address and, when permitted, marks the socket
+// IP_TRANSPARENT so it can also accept TPROXY connections.
+func ListenTransparent(address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				// Without CAP_NET_ADMIN only REDIRECT rules work, which is fine.
+				unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+			})
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
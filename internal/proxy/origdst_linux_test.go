@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// netnsEnv marks the copy of the test binary running inside the network
+// namespace.
+const netnsEnv = "TRUEPROXY_TEST_NETNS"
+
+const (
+	capNetAdmin = 12
+	capSysAdmin = 21
+)
+
+// TestOriginalDst redirects connections with iptables REDIRECT inside a
+// fresh network namespace and checks originalDst recovers where they were
+// going. It needs root or CAP_NET_ADMIN with CAP_SYS_ADMIN, unshare, ip and
+// iptables.
+func TestOriginalDst(t *testing.T) {
+	if os.Getenv(netnsEnv) == "" {
+		if !hasCaps(t, capNetAdmin, capSysAdmin) {
+			t.Skip("needs root or CAP_NET_ADMIN and CAP_SYS_ADMIN")
+		}
+		for _, tool := range []string{"unshare", "ip", "iptables"} {
+			if _, err := exec.LookPath(tool); err != nil {
+				t.Skipf("%s not found", tool)
+			}
+		}
+
+		cmd := exec.Command("unshare", "--net", os.Args[0], "-test.run=^TestOriginalDst$", "-test.v")
+		cmd.Env = append(os.Environ(), netnsEnv+"=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("test in network namespace: %v\n%s", err, out)
+		}
+		t.Logf("%s", out)
+		return
+	}
+
+	run(t, "ip", "link", "set", "lo", "up")
+
+	t.Run("IPv4", func(t *testing.T) {
+		testRedirect(t, "iptables", "tcp4", "127.0.0.1:0", "127.0.0.2", "8443")
+	})
+	t.Run("dual-stack", func(t *testing.T) {
+		// Listeners of ServeTransparent take both families on one socket,
+		// IPv4 connections arrive on it v4-mapped.
+		testRedirect(t, "iptables", "tcp", "[::]:0", "127.0.0.3", "8443")
+	})
+	t.Run("IPv6", func(t *testing.T) {
+		if _, err := exec.LookPath("ip6tables"); err != nil {
+			t.Skip("ip6tables not found")
+		}
+		run(t, "ip", "-6", "addr", "add", "fd00::2/128", "dev", "lo", "nodad")
+		testRedirect(t, "ip6tables", "tcp6", "[::1]:0", "fd00::2", "8443")
+	})
+}
+
+// testRedirect sends connections to dstIP:dstPort to a listener on
+// listenAddr and checks their original destination.
+func testRedirect(t *testing.T, iptables, network, listenAddr, dstIP, dstPort string) {
+	l, err := net.Listen(network, listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	run(t, iptables, "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-d", dstIP, "--dport", dstPort,
+		"-j", "REDIRECT", "--to-ports", port)
+
+	want := net.JoinHostPort(dstIP, dstPort)
+	client, err := net.Dial(network, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	got, err := originalDst(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("originalDst = %s, want %s", got, want)
+	}
+}
+
+func run(t *testing.T, name string, args ...string) {
+	t.Helper()
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		t.Fatalf("%s %s: %v\n%s", name, strings.Join(args, " "), err, out)
+	}
+}
+
+// hasCaps reports whether the process has all of the effective
+// capabilities.
+func hasCaps(t *testing.T, caps ...uint) bool {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		value, ok := strings.CutPrefix(line, "CapEff:")
+		if !ok {
+			continue
+		}
+		eff, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range caps {
+			if eff&(1<<c) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+func originalDst(conn net.Conn) (string, error) {
+	return "", errors.New("original destination is supported on linux only")
+}
+
+func ListenTransparent(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrdjeb/trueproxy/internal/config"
+	"github.com/mrdjeb/trueproxy/internal/models"
+)
+
+const (
+	// rejectedTTL is how long a learned host is passed through.
+	rejectedTTL = time.Hour
+	// suspectFailures handshakes failed with a bad record MAC within
+	// suspectWindow make a host learned.
+	suspectFailures = 3
+	suspectWindow   = 10 * time.Minute
+)
+
+// suspect counts ambiguous handshake failures of a host.
+type suspect struct {
+	failures int
+	since    time.Time
+}
+
+// passthrough decides which TLS connections are spliced to upstream instead
+// of being terminated with a forged certificate.
+type passthrough struct {
+	patterns []string
+	auto     bool
+
+	mu       sync.RWMutex
+	rejected map[string]time.Time // learned host to expiry
+	suspects map[string]suspect
+}
+
+func newPassthrough(cfg config.ProxyServer) *passthrough {
+	return &passthrough{
+		patterns: cfg.Passthrough,
+		auto:     cfg.PassthroughAuto,
+		rejected: make(map[string]time.Time),
+		suspects: make(map[string]suspect),
+	}
+}
+
+// match returns the tunnel reason for target host:port, empty if the
+// connection is intercepted.
+func (pt *passthrough) match(target string) string {
+	host := hostname(target)
+	if host == "" {
+		return ""
+	}
+	if matchHost(pt.patterns, host) {
+		return models.TunnelPassthrough
+	}
+
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+	if expiry, ok := pt.rejected[host]; ok && time.Now().Before(expiry) {
+		return models.TunnelRejected
+	}
+	return ""
+}
+
+// learn remembers host for rejectedTTL if the handshake failed because the
+// client does not trust the forged certificate, e.g. it pins the real one.
+// OpenSSL sends that alert unencrypted in TLS 1.3 and it is seen as a bad
+// record MAC, which a broken connection gives too, so it has to repeat.
+func (pt *passthrough) learn(host string, handshakeErr error) bool {
+	if !pt.auto || host == "" {
+		return false
+	}
+	rejected := isCertRejected(handshakeErr)
+	if !rejected && !isBadRecordMAC(handshakeErr) {
+		return false
+	}
+
+	host = strings.ToLower(host)
+	now := time.Now()
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.prune(now)
+	if !rejected {
+		s := pt.suspects[host]
+		if now.Sub(s.since) > suspectWindow {
+			s = suspect{since: now}
+		}
+		s.failures++
+		if s.failures < suspectFailures {
+			pt.suspects[host] = s
+			return false
+		}
+	}
+	delete(pt.suspects, host)
+	pt.rejected[host] = now.Add(rejectedTTL)
+	return true
+}
+
+// isCertRejected reports whether the client aborted the handshake with an
+// alert about our certificate: bad_certificate, certificate_unknown or
+// unknown_ca. Other failures, e.g. corrupted or reset connections, are not
+// a reason to stop intercepting the host.
+func isCertRejected(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" {
+		return false
+	}
+	switch opErr.Err.Error() {
+	case "tls: unknown certificate authority",
+		"tls: bad certificate",
+		"tls: certificate unknown":
+		return true
+	}
+	return false
+}
+
+// prune forgets expired hosts and stale suspects.
+func (pt *passthrough) prune(now time.Time) {
+	for host, expiry := range pt.rejected {
+		if now.After(expiry) {
+			delete(pt.rejected, host)
+		}
+	}
+	for host, s := range pt.suspects {
+		if now.Sub(s.since) > suspectWindow {
+			delete(pt.suspects, host)
+		}
+	}
+}
+
+func isBadRecordMAC(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "local error" && opErr.Err.Error() == "tls: bad record MAC"
+}
+
+func hostname(target string) string {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	return strings.ToLower(host)
+}
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -17,8 +18,13 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"golang.org/x/net/http2"
+
+	"github.com/mrdjeb/trueproxy/internal/config"
 	"github.com/mrdjeb/trueproxy/internal/logger/sl"
+	"github.com/mrdjeb/trueproxy/internal/scope"
 	"github.com/mrdjeb/trueproxy/internal/storage"
+	"github.com/mrdjeb/trueproxy/internal/writequeue"
 )
 
 const (
@@ -30,15 +36,31 @@ type ProxyHandler struct {
 	log         *slog.Logger
 	TransortTLS *http.Transport
 	cm          *CertManager
+	repo        storage.RequestsRepo
+	writer      *writequeue.Queue
 	rt          http.RoundTripper
+	upstream    *Upstream
+	idleTimeout time.Duration
+	streaming   bool
+	scope       *scope.Scope
+	passthrough *passthrough
+	caPageHost  string
 }
 
-func NewProxy(log *slog.Logger, cm *CertManager, repo storage.RequestsRepo, rt http.RoundTripper) *ProxyHandler {
+func NewProxy(log *slog.Logger, cfg config.ProxyServer, cm *CertManager, repo storage.RequestsRepo, writer *writequeue.Queue, rt http.RoundTripper, upstream *Upstream, scope *scope.Scope) *ProxyHandler {
 
 	return &ProxyHandler{
-		log: log,
-		cm:  cm,
-		rt:  rt,
+		log:         log,
+		cm:          cm,
+		repo:        repo,
+		writer:      writer,
+		rt:          rt,
+		upstream:    upstream,
+		idleTimeout: cfg.IdleTimeout,
+		streaming:   cfg.Streaming,
+		scope:       scope,
+		passthrough: newPassthrough(cfg),
+		caPageHost:  strings.ToLower(cfg.CAPageHost),
 	}
 
 }
@@ -64,7 +86,7 @@ func (p *ProxyHandler) handleHTTP(respW http.ResponseWriter, inReq *http.Request
 	rc := http.NewResponseController(respW)
 	rc.EnableFullDuplex()
 
-	cleanClientConn, _, err := rc.Hijack()
+	cleanClientConn, clientBuf, err := rc.Hijack()
 	if err != nil {
 		log.Error("hijacking fail", sl.Err(err))
 		writeRawClientResponse(log, inReq, cleanClientConn, http.StatusInternalServerError)
@@ -74,17 +96,14 @@ func (p *ProxyHandler) handleHTTP(respW http.ResponseWriter, inReq *http.Request
 
 	//- - - - - - - Hijack client - - - - - - -//
 
-	responseDump, err := p.handleSingle(inReq, proto)
-	if err != nil {
-		log.Error("handle single error", sl.Err(err))
-		writeRawClientResponse(log, inReq, cleanClientConn, http.StatusBadGateway)
+	if isWebSocketUpgrade(inReq.Header) {
+		cleanClientConn.SetDeadline(time.Time{})
+		p.handleWebSocket(log, cleanClientConn, clientBuf.Reader, inReq, proto)
 		return
 	}
 
-	if _, err := cleanClientConn.Write(responseDump); err != nil {
-		log.Error("error writing response back to client connection", sl.Err(err))
-		return
-	}
+	cleanClientConn.SetDeadline(time.Time{})
+	p.handleSingle(log, cleanClientConn, inReq, proto)
 }
 
 func (p *ProxyHandler) handleHTTPS(respW http.ResponseWriter, inReq *http.Request) {
@@ -107,6 +126,12 @@ func (p *ProxyHandler) handleHTTPS(respW http.ResponseWriter, inReq *http.Reques
 		return
 	}
 	defer cleanClientConn.Close()
+
+	// Hijacked connection still holds the deadlines of the CONNECT request.
+	if err := cleanClientConn.SetDeadline(time.Time{}); err != nil {
+		log.Error("error reset client connection deadline", sl.Err(err))
+		return
+	}
 	//- - - - - - - Hijack client - - - - - - -//
 
 	//= = = = = = = Setup TLS = = = = = = =//
@@ -114,73 +139,242 @@ func (p *ProxyHandler) handleHTTPS(respW http.ResponseWriter, inReq *http.Reques
 		log.Error("error accept CONNECT_METHOD to client:", sl.Err(err))
 		return
 	}
+	//- - - - - - - Setup TLS - - - - - - -//
 
-	tlsClientConn := tls.Server(cleanClientConn, p.cm.NewTLSConfig(inReq.URL.Host))
-	defer tlsClientConn.Close()
+	p.serveTLSOrTunnel(context.Background(), log, cleanClientConn, inReq.URL.Host, nil)
+}
+
+// serveTLSOrTunnel intercepts TLS to target unless it is passed through or
+// nothing on it can be in scope. The CA page host is always intercepted.
+// upstreamConn is as in serveSniffed.
+func (p *ProxyHandler) serveTLSOrTunnel(ctx context.Context, log *slog.Logger, clientConn net.Conn, target string, upstreamConn net.Conn) {
+	if p.caPageHost != "" && hostname(target) == p.caPageHost {
+		closeConn(upstreamConn)
+		p.serveTLS(ctx, log, clientConn, target)
+		return
+	}
+	if reason := p.passthrough.match(target); reason != "" {
+		log.Debug("passthrough, tunneling", slog.String("target", target), slog.String("reason", reason))
+		p.tunnel(log, clientConn, target, reason, upstreamConn)
+		return
+	}
+	if p.outOfScopeTunnel(target) {
+		log.Debug("out of scope, tunneling", slog.String("target", target))
+		p.tunnel(log, clientConn, target, "", upstreamConn)
+		return
+	}
+	closeConn(upstreamConn)
+	p.serveTLS(ctx, log, clientConn, target)
+}
 
-	connReader := bufio.NewReader(tlsClientConn)
+// outOfScopeTunnel reports whether TLS to target is passed without MITM
+// because nothing on it can be in scope.
+func (p *ProxyHandler) outOfScopeTunnel(target string) bool {
+	return p.scope != nil && target != "" && p.scope.Tunnel(scope.HostTarget(HTTPS, target))
+}
+
+// serveTLS terminates client TLS with a forged certificate for target and
+// serves the decrypted HTTP/1.x or HTTP/2 requests, all of them carry ctx.
+func (p *ProxyHandler) serveTLS(ctx context.Context, log *slog.Logger, clientConn net.Conn, target string) {
+	helloConn := newHelloConn(clientConn)
+	tlsClientConn := tls.Server(helloConn, p.cm.NewTLSConfig(target))
+	defer tlsClientConn.Close()
 
-	r, err := http.ReadRequest(connReader) // only supports HTTP/1.x requests
-	opErr, okOp := err.(*net.OpError)
-	netErr, okNet := err.(net.Error)
-	switch {
-	case err == io.EOF:
-		log.Info("Client close the connection")
+	if p.idleTimeout > 0 {
+		tlsClientConn.SetDeadline(time.Now().Add(p.idleTimeout))
+	}
+	if err := tlsClientConn.Handshake(); err != nil {
+		log.Warn("TLS handshake with client failed", sl.Err(err))
+		host := hostname(target)
+		if host == "" {
+			host = tlsClientConn.ConnectionState().ServerName
+		}
+		if p.passthrough.learn(host, err) {
+			log.Info("client rejected forged certificate, host is passed through from now", slog.String("host", host))
+		}
 		return
-	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED):
-		log.Error("Client connection reset by peer error", sl.Err(err))
+	}
+	tlsClientConn.SetDeadline(time.Time{})
+
+	// Every request of the tunnel is stored with what the client offered.
+	if hello, err := helloConn.clientHello(); err != nil {
+		log.Warn("failed to parse ClientHello", sl.Err(err))
+	} else {
+		ctx = withClientHello(ctx, hello)
+	}
+
+	if tlsClientConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		p.serveH2(ctx, log, tlsClientConn, HTTPS)
 		return
-	case okNet:
-		if !netErr.Timeout() {
-			log.Warn("Client connection force close, tcp", sl.Err(netErr))
+	}
+	p.serveConn(ctx, log, tlsClientConn, HTTPS, target)
+}
+
+// serveH2 multiplexes HTTP/2 streams of the client connection, every stream
+// goes through the same round tripper as HTTP/1.x requests.
+func (p *ProxyHandler) serveH2(ctx context.Context, log *slog.Logger, clientConn net.Conn, proto string) {
+	srv := &http2.Server{
+		IdleTimeout: p.idleTimeout,
+	}
+	srv.ServeConn(clientConn, &http2.ServeConnOpts{
+		Context: ctx,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			resp, err := p.roundTrip(r, proto)
+			if err != nil {
+				log.Error("handle stream error", sl.Err(err))
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := p.writeStream(w, resp); err != nil {
+				log.Error("error writing response back to client stream", sl.Err(err))
+			}
+		}),
+	})
+}
+
+// writeStream copies the upstream response into a server ResponseWriter.
+func (p *ProxyHandler) writeStream(w http.ResponseWriter, resp *http.Response) error {
+	for k, values := range resp.Header {
+		w.Header()[k] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	var dst io.Writer = w
+	if p.streaming {
+		dst = flushWriter{w: w}
+	}
+	_, err := io.Copy(dst, resp.Body)
+	return err
+}
+
+// serveConn reads requests from the client connection one by one until the
+// client closes it or stays idle longer than idleTimeout. Requests without
+// Host header are sent to target, all of them carry ctx.
+func (p *ProxyHandler) serveConn(ctx context.Context, log *slog.Logger, clientConn net.Conn, proto string, target string) {
+	connReader := bufio.NewReader(clientConn)
+
+	for {
+		if p.idleTimeout > 0 {
+			clientConn.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		}
+
+		r, err := http.ReadRequest(connReader) // only supports HTTP/1.x requests
+		opErr, okOp := err.(*net.OpError)
+		netErr, okNet := err.(net.Error)
+		switch {
+		case err == io.EOF:
+			log.Info("Client close the connection")
 			return
-		} else {
-			log.Error("Read request from client connection error, netERr", sl.Err(netErr))
+		case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED):
+			log.Error("Client connection reset by peer error", sl.Err(err))
 			return
+		case okNet:
+			if !netErr.Timeout() {
+				log.Warn("Client connection force close, tcp", sl.Err(netErr))
+				return
+			} else {
+				log.Info("Client connection idle timeout")
+				return
+			}
+		case okOp:
+			if opErr.Op == "read" {
+				log.Info("Client read error, tcp")
+				return
+			} else {
+				log.Error("Read request from client connection error, opErr", sl.Err(opErr))
+				return
+			}
+		case err != nil:
+			log.Error("Read request from client connection error", sl.Err(err))
+			return
+		}
+
+		clientConn.SetReadDeadline(time.Time{})
+		r = r.WithContext(ctx)
+
+		if r.Host == "" {
+			r.Host = target
 		}
-	case okOp:
-		if opErr.Op == "read" {
-			log.Info("Client read error, tcp")
+
+		if isWebSocketUpgrade(r.Header) {
+			p.handleWebSocket(log, clientConn, connReader, r, proto)
 			return
-		} else {
-			log.Error("Read request from client connection error, opErr", sl.Err(opErr))
+		}
+
+		if !p.handleSingle(log, clientConn, r, proto) {
 			return
 		}
-	case err != nil:
-		log.Error("Read request from client connection error", sl.Err(err))
-		return
 	}
+}
 
-	//- - - - - - - Setup TLS - - - - - - -//
+// handleSingle proxies one request and writes the response back to the client
+// connection. It reports whether the connection may serve the next request.
+func (p *ProxyHandler) handleSingle(log *slog.Logger, clientConn net.Conn, inReq *http.Request, proto string) bool {
+	if inReq.Body != nil {
+		defer inReq.Body.Close()
+	}
 
-	responseDump, err := p.handleSingle(r, proto)
+	resp, err := p.roundTrip(inReq, proto)
 	if err != nil {
 		log.Error("handle single error", sl.Err(err))
-		writeRawClientResponse(log, inReq, cleanClientConn, http.StatusBadGateway)
-		return
+		writeRawClientResponse(log, inReq, clientConn, http.StatusBadGateway)
+		return false
+	}
+	defer resp.Body.Close()
+
+	// Upstream may answer over HTTP/2, but the response goes back to the client connection.
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = inReq.Proto, inReq.ProtoMajor, inReq.ProtoMinor
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 && inReq.ProtoAtLeast(1, 1) {
+		resp.TransferEncoding = []string{"chunked"}
 	}
 
-	if _, err := tlsClientConn.Write(responseDump); err != nil {
+	if err := p.writeResponse(clientConn, resp); err != nil {
 		log.Error("error writing response back to client connection", sl.Err(err))
-		return
+		return false
+	}
+
+	return !inReq.Close && !resp.Close
+}
+
+// writeResponse either forwards the body as it arrives or, with streaming
+// disabled, buffers the whole response first.
+func (p *ProxyHandler) writeResponse(w io.Writer, resp *http.Response) error {
+	if !p.streaming {
+		responseDump, err := httputil.DumpResponse(resp, true)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(responseDump)
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	resp.Body = flushReader{ReadCloser: resp.Body, w: bw}
+	// Hide bufio.Writer.ReadFrom, it would read the body into the buffer being flushed.
+	if err := resp.Write(struct{ io.Writer }{bw}); err != nil {
+		return err
 	}
+	return bw.Flush()
 }
 
-func (p *ProxyHandler) handleSingle(inReq *http.Request, proto string) ([]byte, error) {
+// roundTrip sends the client request to its target and returns the upstream
+// response with hop-by-hop headers removed. Caller must close response body.
+func (p *ProxyHandler) roundTrip(inReq *http.Request, proto string) (*http.Response, error) {
+	if p.isCAPageHost(inReq) {
+		return p.caPage(inReq), nil
+	}
 
 	ctx := inReq.Context()
 	outReq := inReq.Clone(ctx)
 
-	// for https only
 	ChangeRequestToTarget(outReq, inReq.Host, proto)
 
 	outReq.RequestURI = ""
 	if inReq.ContentLength == 0 {
 		outReq.Body = nil
 	}
-	if outReq.Body != nil {
-		defer outReq.Body.Close()
-	}
 	if outReq.Header == nil {
 		outReq.Header = make(http.Header)
 	}
@@ -188,31 +382,53 @@ func (p *ProxyHandler) handleSingle(inReq *http.Request, proto string) ([]byte,
 
 	removeHopByHopHeaders(outReq.Header)
 
+	upgrade := isWebSocketUpgrade(inReq.Header)
+	if upgrade {
+		outReq.Header.Set("Connection", "Upgrade")
+		outReq.Header.Set("Upgrade", "websocket")
+	}
+
 	if _, ok := outReq.Header["User-Agent"]; !ok {
 		outReq.Header.Set("User-Agent", "")
 	}
 
+	// Upstream timeout is up to the round tripper, it must not count the
+	// time a request or response is held by intercept.
 	client := http.Client{
 		Transport: p.rt,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
-		Timeout: 30 * time.Second,
 	}
 
-	resp, err := client.Do(outReq)
+	var resp *http.Response
+	var err error
+	if upgrade {
+		resp, err = p.rt.RoundTrip(outReq)
+	} else {
+		resp, err = client.Do(outReq)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error in client DO: %w", err)
 	}
-	defer resp.Body.Close()
 
 	removeHopByHopHeaders(resp.Header)
 
-	return httputil.DumpResponse(resp, true)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Header.Set("Connection", "Upgrade")
+		resp.Header.Set("Upgrade", "websocket")
+	}
+
+	return resp, nil
 }
 
 func ChangeRequestToTarget(req *http.Request, targetHost string, proto string) error {
 	if proto != HTTPS {
+		// Origin-form request read from a tunnel, target comes from Host header.
+		if req.URL.Host == "" {
+			req.URL.Scheme = HTTP
+			req.URL.Host = targetHost
+		}
 		return nil
 	}
 
@@ -242,6 +458,32 @@ func writeRawClientResponse(log *slog.Logger, r *http.Request, tlsClientConn net
 	return true
 }
 
+// flushReader flushes buffered client writes before waiting for the next
+// upstream chunk, so streamed bytes are never held back.
+type flushReader struct {
+	io.ReadCloser
+	w *bufio.Writer
+}
+
+func (f flushReader) Read(p []byte) (int, error) {
+	if err := f.w.Flush(); err != nil {
+		return 0, err
+	}
+	return f.ReadCloser.Read(p)
+}
+
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil {
+		err = http.NewResponseController(f.w).Flush()
+	}
+	return n, err
+}
+
 var hopHeaders = []string{
 	"Connection",
 	"Proxy-Connection",
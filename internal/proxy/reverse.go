@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mrdjeb/trueproxy/internal/logger/sl"
+)
+
+const REVERSE = "reverse"
+
+// ReverseHandler serves every incoming request from a single fixed upstream
+// and captures exchanges the same way forward proxying does.
+type ReverseHandler struct {
+	p      *ProxyHandler
+	target *url.URL
+}
+
+func NewReverse(p *ProxyHandler, target string) (*ReverseHandler, error) {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("bad reverse upstream url: %w", err)
+	}
+	if targetURL.Scheme != HTTP && targetURL.Scheme != HTTPS || targetURL.Host == "" {
+		return nil, fmt.Errorf("reverse upstream must be http:// or https:// url, got %q", target)
+	}
+
+	return &ReverseHandler{
+		p:      p,
+		target: targetURL,
+	}, nil
+}
+
+func (h *ReverseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := h.p.log.With(
+		slog.String("Proto", REVERSE),
+		slog.String("request-ID", uuid.New().String()),
+	)
+
+	proto := HTTP
+	if r.TLS != nil {
+		proto = HTTPS
+	}
+	r.Header.Set("X-Forwarded-Host", r.Host)
+	r.Header.Set("X-Forwarded-Proto", proto)
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		r.Header.Set("X-Forwarded-For", clientIP)
+	}
+
+	r.Host = h.target.Host
+	r.URL.Path = strings.TrimSuffix(h.target.Path, "/") + r.URL.Path
+
+	rc := http.NewResponseController(w)
+
+	if isWebSocketUpgrade(r.Header) {
+		clientConn, clientBuf, err := rc.Hijack()
+		if err != nil {
+			log.Error("hijacking fail", sl.Err(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer clientConn.Close()
+
+		clientConn.SetDeadline(time.Time{})
+		h.p.handleWebSocket(log, clientConn, clientBuf.Reader, r, h.target.Scheme)
+		return
+	}
+
+	// Uploads, slow upstreams and large responses outlive the listener
+	// timeouts meant for reading request headers.
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	resp, err := h.p.roundTrip(r, h.target.Scheme)
+	if err != nil {
+		log.Error("handle single error", sl.Err(err))
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := h.p.writeStream(w, resp); err != nil {
+		log.Error("error writing response back to client", sl.Err(err))
+	}
+}
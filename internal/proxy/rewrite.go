@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+
+	"github.com/mrdjeb/trueproxy/internal/models"
+	"github.com/mrdjeb/trueproxy/internal/rewrite"
+)
+
+// original is a message as it was before rewrite rules. body is nil when
+// the body was left untouched and its captured copy is the original.
+type original struct {
+	head []byte
+	body []byte
+}
+
+func (o *original) raw(captured []byte) string {
+	if o.body != nil {
+		captured = o.body
+	}
+	return rawMessage(o.head, captured)
+}
+
+// rewriteRequest applies matching rewrite rules to r in place. It returns
+// nil if nothing was changed.
+func (rt proxyRoundTripper) rewriteRequest(r *http.Request) (*original, error) {
+	if rt.rewriter == nil {
+		return nil, nil
+	}
+	rules := rt.rewriter.Match(rewrite.StageRequest, r.Method, r.URL.Hostname(), r.URL.Path)
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	head, err := httputil.DumpRequest(r, false)
+	if err != nil {
+		return nil, err
+	}
+	orig := &original{head: head}
+
+	// Host lives outside of the header map, expose it to header rules.
+	r.Header.Set("Host", r.Host)
+	changed := applyHeaderRules(rules, r.Header)
+	r.Host = r.Header.Get("Host")
+	r.Header.Del("Host")
+
+	if r.Body != nil && r.Body != http.NoBody {
+		body, rest, n, err := rt.applyBodyRules(rules, r.Header, r.Body)
+		if err != nil {
+			return nil, err
+		}
+		r.Body = rest
+		if body != nil {
+			orig.body = body
+			r.ContentLength = n
+			r.TransferEncoding = nil
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil, nil
+	}
+	return orig, nil
+}
+
+// rewriteResponse is rewriteRequest for the upstream response.
+func (rt proxyRoundTripper) rewriteResponse(r *http.Request, resp *http.Response) (*original, error) {
+	if rt.rewriter == nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		return nil, nil
+	}
+	rules := rt.rewriter.Match(rewrite.StageResponse, r.Method, r.URL.Hostname(), r.URL.Path)
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	head, err := httputil.DumpResponse(resp, false)
+	if err != nil {
+		return nil, err
+	}
+	orig := &original{head: head}
+
+	changed := applyHeaderRules(rules, resp.Header)
+	for _, rule := range rules {
+		if rule.Type == models.RewriteStatus && rule.Status != resp.StatusCode {
+			resp.StatusCode = rule.Status
+			resp.Status = fmt.Sprintf("%d %s", rule.Status, http.StatusText(rule.Status))
+			changed = true
+		}
+	}
+
+	if resp.Body != nil && resp.Body != http.NoBody {
+		body, rest, n, err := rt.applyBodyRules(rules, resp.Header, resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = rest
+		if body != nil {
+			orig.body = body
+			resp.ContentLength = n
+			resp.TransferEncoding = nil
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil, nil
+	}
+	return orig, nil
+}
+
+func applyHeaderRules(rules []rewrite.Rule, h http.Header) bool {
+	changed := false
+	for i := range rules {
+		changed = rules[i].ApplyHeader(h) || changed
+	}
+	return changed
+}
+
+// applyBodyRules buffers the body and runs body rules on it. Bodies larger
+// than the capture limit or in an unknown encoding are passed as is. The
+// returned reader must replace the consumed body in any case. On change the
+// original raw body and the new length are returned.
+func (rt proxyRoundTripper) applyBodyRules(rules []rewrite.Rule, h http.Header, body io.ReadCloser) ([]byte, io.ReadCloser, int64, error) {
+	hasBodyRules := false
+	for _, rule := range rules {
+		hasBodyRules = hasBodyRules || rule.Type == models.RewriteBody
+	}
+	if !hasBodyRules {
+		return nil, body, 0, nil
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(body, int64(rt.bodyLimit)+1))
+	if err != nil {
+		body.Close()
+		return nil, nil, 0, err
+	}
+	if len(raw) > rt.bodyLimit {
+		return nil, readCloser{io.MultiReader(bytes.NewReader(raw), body), body}, 0, nil
+	}
+	body.Close()
+	unchanged := io.NopCloser(bytes.NewReader(raw))
+
+	decoded := raw
+	switch h.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		if decoded, err = gunzip(raw); err != nil {
+			return nil, unchanged, 0, nil
+		}
+	default:
+		return nil, unchanged, 0, nil
+	}
+
+	replaced := decoded
+	for i := range rules {
+		replaced = rules[i].ApplyBody(replaced)
+	}
+	if bytes.Equal(replaced, decoded) {
+		return nil, unchanged, 0, nil
+	}
+
+	// Rewritten body is sent without content encoding.
+	h.Del("Content-Encoding")
+	h.Del("Transfer-Encoding")
+	h.Set("Content-Length", strconv.Itoa(len(replaced)))
+	return raw, io.NopCloser(bytes.NewReader(replaced)), int64(len(replaced)), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func gunzip(raw []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/mrdjeb/trueproxy/internal/logger/sl"
+	"github.com/mrdjeb/trueproxy/internal/models"
+)
+
+// sniffTimeout bounds the wait for the first client bytes, protocols where
+// the server speaks first are tunneled once it expires.
+const sniffTimeout = 2 * time.Second
+
+const recordTypeHandshake = 0x16
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("TRACE "), []byte("CONNECT "),
+}
+
+// maxMethodLen is the longest of httpMethods without the space.
+const maxMethodLen = len("OPTIONS")
+
+// bufferedConn is a net.Conn whose first bytes were already read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// serveSniffed looks at the first bytes of a stream to target and sends it
+// into MITM for TLS, into the capture pipeline for plain HTTP, or passes it
+// through unmodified otherwise. upstreamConn, if not nil, is an already
+// dialed stream to target used by a tunnel, it is closed otherwise.
+// Intercepted requests carry ctx.
+func (p *ProxyHandler) serveSniffed(ctx context.Context, log *slog.Logger, clientConn net.Conn, target string, upstreamConn net.Conn) {
+	br := bufio.NewReader(clientConn)
+	conn := &bufferedConn{Conn: clientConn, r: br}
+
+	clientConn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	_, err := br.Peek(1)
+	clientConn.SetReadDeadline(time.Time{})
+	if err != nil {
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			log.Info("Client close the connection before sending data", sl.Err(err))
+			closeConn(upstreamConn)
+			return
+		}
+		p.tunnel(log, conn, target, models.TunnelRaw, upstreamConn)
+		return
+	}
+
+	// An HTTP method token needs a few more bytes than the first packet
+	// may carry.
+	clientConn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	head, _ := br.Peek(maxMethodLen + 1)
+	clientConn.SetReadDeadline(time.Time{})
+	switch {
+	case head[0] == recordTypeHandshake:
+		p.serveTLSOrTunnel(ctx, log, conn, target, upstreamConn)
+	case looksLikeHTTP(head):
+		closeConn(upstreamConn)
+		p.serveConn(ctx, log, conn, HTTP, target)
+	default:
+		p.tunnel(log, conn, target, models.TunnelRaw, upstreamConn)
+	}
+}
+
+func closeConn(conn net.Conn) {
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// looksLikeHTTP reports whether head starts with a full method token and
+// a space.
+func looksLikeHTTP(head []byte) bool {
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(head, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnel splices client and target connections without looking into the
+// stream. Its metadata is stored unless reason is empty. Target is dialed
+// unless upstreamConn is given.
+func (p *ProxyHandler) tunnel(log *slog.Logger, clientConn net.Conn, target string, reason string, upstreamConn net.Conn) {
+	started := time.Now()
+	if upstreamConn == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		var err error
+		upstreamConn, err = p.upstream.Dial(ctx, target)
+		cancel()
+		if err != nil {
+			log.Error("error dial tunnel target", sl.Err(err))
+			return
+		}
+	}
+	defer upstreamConn.Close()
+
+	var bytesUp, bytesDown int64
+	errc := make(chan error, 2)
+	go func() {
+		var err error
+		bytesUp, err = io.Copy(upstreamConn, clientConn)
+		errc <- err
+	}()
+	go func() {
+		var err error
+		bytesDown, err = io.Copy(clientConn, upstreamConn)
+		errc <- err
+	}()
+
+	if err := <-errc; err != nil {
+		log.Debug("tunnel closed", sl.Err(err))
+	}
+	upstreamConn.Close()
+	clientConn.Close()
+	<-errc
+
+	if reason == "" {
+		return
+	}
+	tunnel := &models.Tunnel{
+		Host:      target,
+		Reason:    reason,
+		BytesUp:   bytesUp,
+		BytesDown: bytesDown,
+		Started:   started,
+		Duration:  time.Since(started),
+	}
+	p.writer.Enqueue("tunnel", func() error {
+		return p.repo.CreateTunnel(tunnel)
+	})
+}
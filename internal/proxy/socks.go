@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mrdjeb/trueproxy/internal/logger/sl"
+)
+
+const (
+	SOCKS5 = "socks5"
+
+	socksVersion      = 0x05
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xff
+	socksCmdConnect   = 0x01
+	socksAtypIPv4     = 0x01
+	socksAtypDomain   = 0x03
+	socksAtypIPv6     = 0x04
+
+	socksSucceeded            = 0x00
+	socksGeneralFailure       = 0x01
+	socksNetworkUnreachable   = 0x03
+	socksHostUnreachable      = 0x04
+	socksConnectionRefused    = 0x05
+	socksTTLExpired           = 0x06
+	socksCmdNotSupported      = 0x07
+	socksAddrTypeNotSupported = 0x08
+)
+
+// ServeSOCKS accepts SOCKS5 clients on l until it is closed. Every CONNECT
+// stream goes into the same MITM and capture pipeline as HTTP proxy clients.
+func (p *ProxyHandler) ServeSOCKS(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go p.handleSOCKS(conn)
+	}
+}
+
+func (p *ProxyHandler) handleSOCKS(clientConn net.Conn) {
+	defer clientConn.Close()
+
+	log := p.log.With(
+		slog.String("Proto", SOCKS5),
+		slog.String("request-ID", uuid.New().String()),
+	)
+
+	if p.idleTimeout > 0 {
+		clientConn.SetDeadline(time.Now().Add(p.idleTimeout))
+	}
+	br := bufio.NewReader(clientConn)
+
+	target, err := socksHandshake(br, clientConn)
+	if err != nil {
+		log.Warn("SOCKS handshake with client failed", sl.Err(err))
+		return
+	}
+
+	// The client is told the outcome of connecting to target, the stream
+	// is used if the connection is tunneled.
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	upstreamConn, err := p.upstream.Dial(ctx, target)
+	cancel()
+	if err != nil {
+		log.Warn("SOCKS target is unreachable", slog.String("target", target), sl.Err(err))
+		writeSocksReply(clientConn, socksReplyCode(err))
+		return
+	}
+	if err := writeSocksReply(clientConn, socksSucceeded); err != nil {
+		upstreamConn.Close()
+		log.Warn("SOCKS reply to client failed", sl.Err(err))
+		return
+	}
+	clientConn.SetDeadline(time.Time{})
+
+	log.Debug("SOCKS connect", slog.String("target", target))
+	p.serveSniffed(context.Background(), log, &bufferedConn{Conn: clientConn, r: br}, target, upstreamConn)
+}
+
+// socksHandshake negotiates "no authentication" and reads a CONNECT
+// command. It returns the requested target as host:port, the reply is left
+// to the caller once target is dialed.
+func socksHandshake(r io.Reader, w io.Writer) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("socks: unsupported version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := w.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksNoAcceptable {
+		return "", errors.New("socks: no acceptable auth method")
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(r, req[:]); err != nil {
+		return "", err
+	}
+	if req[1] != socksCmdConnect {
+		writeSocksReply(w, socksCmdNotSupported)
+		return "", fmt.Errorf("socks: unsupported command %d", req[1])
+	}
+
+	var host string
+	switch req[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if req[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		var size [1]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		writeSocksReply(w, socksAddrTypeNotSupported)
+		return "", fmt.Errorf("socks: unsupported address type %d", req[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksReplyCode maps a dial error to the RFC 1928 reply.
+func socksReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socksHostUnreachable
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		return socksTTLExpired
+	}
+	return socksGeneralFailure
+}
+
+func writeSocksReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socksVersion, code, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+
+	"github.com/google/uuid"
+	"github.com/mrdjeb/trueproxy/internal/logger/sl"
+)
+
+const TRANSPARENT = "transparent"
+
+// ServeTransparent accepts connections redirected to l by iptables REDIRECT
+// or TPROXY rules until it is closed. Target is recovered from the original
+// destination of the connection, SNI or Host header.
+func (p *ProxyHandler) ServeTransparent(l net.Listener) error {
+	_, listenPort, _ := net.SplitHostPort(l.Addr().String())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go p.handleTransparent(conn, listenPort)
+	}
+}
+
+func (p *ProxyHandler) handleTransparent(clientConn net.Conn, listenPort string) {
+	defer clientConn.Close()
+
+	log := p.log.With(
+		slog.String("Proto", TRANSPARENT),
+		slog.String("request-ID", uuid.New().String()),
+	)
+
+	target, err := originalDst(clientConn)
+	if err != nil {
+		// TPROXY keeps the original destination as the local address.
+		if _, localPort, _ := net.SplitHostPort(clientConn.LocalAddr().String()); localPort != listenPort {
+			target = clientConn.LocalAddr().String()
+		} else {
+			log.Debug("original destination is unknown, fall back to SNI or Host", sl.Err(err))
+		}
+	}
+
+	ctx := context.Background()
+	if target != "" {
+		ctx = withOriginalDst(ctx, target)
+	}
+
+	log.Debug("transparent connect", slog.String("target", target))
+	p.serveSniffed(ctx, log, clientConn, target, nil)
+}
+
+type originalDstKey struct{}
+
+// withOriginalDst marks requests of a connection redirected from addr, they
+// are sent there whatever their Host is.
+func withOriginalDst(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, originalDstKey{}, addr)
+}
+
+// originalDstDialer connects requests to the original destination of their
+// client connection, if known, instead of the address of their Host.
+// Overridden hosts still go to their override.
+func originalDstDialer(overrides hostOverrides, dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if dst, ok := ctx.Value(originalDstKey{}).(string); ok && !overrides.match(hostname(addr)) {
+			addr = dst
+		}
+		return dial(ctx, network, addr)
+	}
+}
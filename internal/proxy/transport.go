@@ -1,39 +1,93 @@
 package proxy
 
 import (
-	"bytes"
-	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/mrdjeb/trueproxy/internal/config"
+	"github.com/mrdjeb/trueproxy/internal/intercept"
 	"github.com/mrdjeb/trueproxy/internal/logger/sl"
 	"github.com/mrdjeb/trueproxy/internal/models"
+	"github.com/mrdjeb/trueproxy/internal/rewrite"
+	"github.com/mrdjeb/trueproxy/internal/scope"
 	"github.com/mrdjeb/trueproxy/internal/storage"
+	"github.com/mrdjeb/trueproxy/internal/writequeue"
 )
 
+type exchangeKey struct{}
+
+// exchange lets the caller of proxyRoundTripper get back the record queued
+// for storage. Its ID is set once the record is written, so it is read only
+// by writes queued after it.
+type exchange struct {
+	record *models.RequestResponse
+}
+
+func withExchange(ctx context.Context, ex *exchange) context.Context {
+	return context.WithValue(ctx, exchangeKey{}, ex)
+}
+
+// upstreamTimeout bounds an exchange with upstream. Streamed responses
+// are bounded by it until headers arrive and then between body reads only,
+// so long bodies are not cut off.
+const upstreamTimeout = 30 * time.Second
+
 type proxyRoundTripper struct {
-	next http.RoundTripper
-	log  *slog.Logger
-	repo storage.RequestsRepo
+	next      http.RoundTripper
+	timeout   time.Duration // of the upstream exchange
+	streaming bool          // timeout is idle time between body reads
+	log       *slog.Logger
+	repo      storage.RequestsRepo
+	writer    *writequeue.Queue
+	bodyLimit int
+	queue     *intercept.Queue
+	rewriter  *rewrite.Engine
+	scope     *scope.Scope
 }
 
-func NewProxyRoundTripper(log *slog.Logger, repo storage.RequestsRepo) *proxyRoundTripper {
+func NewProxyRoundTripper(log *slog.Logger, cfg config.ProxyServer, repo storage.RequestsRepo, writer *writequeue.Queue, next http.RoundTripper, queue *intercept.Queue, rewriter *rewrite.Engine, scope *scope.Scope) *proxyRoundTripper {
 	return &proxyRoundTripper{
-		next: http.DefaultTransport,
-		log:  log,
-		repo: repo,
+		next:      next,
+		timeout:   upstreamTimeout,
+		streaming: cfg.Streaming,
+		log:       log,
+		repo:      repo,
+		writer:    writer,
+		bodyLimit: cfg.CaptureBodyLimit,
+		queue:     queue,
+		rewriter:  rewriter,
+		scope:     scope,
 	}
 }
 
 func (rt proxyRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
-	dumpRequest, err := httputil.DumpRequest(r, true)
+	reqOrig, err := rt.rewriteRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err = rt.holdRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The timeout starts once the request is released. Upgraded
+	// connections live as long as they need.
+	var timer *exchangeTimer
+	if !isWebSocketUpgrade(r.Header) {
+		timer, r = startExchangeTimer(r, rt.timeout)
+	}
+
+	dumpRequest, err := httputil.DumpRequest(r, false)
 	if err != nil {
 		rt.log.Error("error while dump request %w", sl.Err(err))
 	} else {
@@ -42,95 +96,209 @@ func (rt proxyRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
 	}
 
 	rDump := ParseRequest(r)
-	if r.Body != nil {
-		/*reader, err := r.GetBody()
-		if err != nil {
-			rt.log.Error("error GetBody", sl.Err(err))
-		}*/
-
-		// Check that the server actual sent compressed data
-		var reader io.ReadCloser
-		switch r.Header.Get("Content-Encoding") {
-		case "gzip":
-			reader, err = gzip.NewReader(r.Body)
-			if err != nil {
-				rt.log.Error("error gzip.NewReader", sl.Err(err))
-			}
-			defer reader.Close()
-		default:
-			reader = r.Body
-		}
 
-		bodyRaw, err := io.ReadAll(reader)
-		if err != nil {
-			rt.log.Error("error ReadAll", sl.Err(err))
-		}
-		rDump.Body = string(bodyRaw)
-		//reader.Close()
+	// Bodies are streamed to upstream and back, only their copy is kept for storage.
+	var reqBody *captureBody
+	if r.Body != nil && r.Body != http.NoBody {
+		reqBody = newCaptureBody(r.Body, rt.bodyLimit, nil)
+		r.Body = reqBody
 	}
-	rDump.Raw = string(dumpRequest)
+
+	var upstreamAddr string
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			upstreamAddr = info.Conn.RemoteAddr().String()
+		},
+	}))
 
 	resp, err := rt.next.RoundTrip(r)
 	if err != nil {
+		timer.stop()
 		return resp, err
 	}
 
-	respDump := ParseResponse(resp)
-	if resp.Body != nil {
-
-		var reader io.ReadCloser
-		switch resp.Header.Get("Content-Encoding") {
-		case "gzip":
-			reader, err = gzip.NewReader(resp.Body)
-			if err != nil {
-				rt.log.Error("error gzip.NewReader", sl.Err(err))
-			}
-			defer reader.Close()
-		default:
-			reader = resp.Body
-		}
+	respOrig, err := rt.rewriteResponse(r, resp)
+	if err != nil {
+		resp.Body.Close()
+		timer.stop()
+		return nil, err
+	}
 
-		rawBody, err := io.ReadAll(reader)
-		if err != nil {
-			rt.log.Error("error ReadAll", sl.Err(err))
-		}
-		err = resp.Body.Close()
-		if err != nil {
-			rt.log.Error("error resp.Body.Clos", sl.Err(err))
-		}
-		body := io.NopCloser(bytes.NewReader(rawBody))
-		resp.Body = body
-		resp.ContentLength = int64(len(rawBody))
-		resp.Header.Set("Content-Length", strconv.Itoa(len(rawBody)))
-		respDump.Body = string(rawBody)
+	// A held response gets the full timeout again once released.
+	resp, err = rt.holdResponse(r, resp, timer)
+	if err != nil {
+		timer.stop()
+		return nil, err
+	}
+	if timer != nil && resp.Body != nil {
+		resp.Body = &timedBody{ReadCloser: resp.Body, timer: timer, idle: rt.streaming}
 	}
 
-	dumpResponse, err := httputil.DumpResponse(resp, true)
+	respDump := ParseResponse(resp)
+
+	dumpResponse, err := httputil.DumpResponse(resp, false)
 	if err != nil {
 		rt.log.Error("error while dump response %w", sl.Err(err))
 	} else {
 		rt.log.Info("Response dump", "response", string(dumpResponse)) //fmt.Sprintf("[%s] %s %s %d\n", time.Now().Format(time.ANSIC), r.Method, r.URL.Host, resp.StatusCode))
 		//fmt.Sprintf("[%s] %s %s %d\n", time.Now().Format(time.ANSIC), r.Method, r.URL.String(), resp.StatusCode)
 	}
-	respDump.Raw = string(dumpResponse)
 
-	err = rt.repo.CreateRequest(
-		&models.RequestResponse{
+	save := func(rawBody []byte, truncated bool) {
+		if rt.scope != nil {
+			target := scope.HostTarget(r.URL.Scheme, r.Host)
+			target.Path = r.URL.Path
+			target.ContentType = resp.Header.Get("Content-Type")
+			if !rt.scope.InScope(target) {
+				rt.log.Debug("out of scope, not stored", slog.String("host", r.Host), slog.String("path", r.URL.Path))
+				return
+			}
+		}
+
+		var rawReqBody []byte
+		if reqBody != nil {
+			var reqTruncated bool
+			rawReqBody, reqTruncated = reqBody.Captured()
+			rDump.Body = decodeBody(r.Header.Get("Content-Encoding"), rawReqBody)
+			rDump.Truncated = reqTruncated
+			rDump.PostParams = parsePostParams(r.Header.Get("Content-Type"), rDump.Body)
+		}
+		rDump.Raw = rawMessage(dumpRequest, rawReqBody)
+		if reqOrig != nil {
+			rDump.Modified = true
+			rDump.RawOrig = reqOrig.raw(rawReqBody)
+		}
+
+		respDump.Body = decodeBody(resp.Header.Get("Content-Encoding"), rawBody)
+		respDump.Truncated = truncated
+		respDump.Raw = rawMessage(dumpResponse, rawBody)
+		if respOrig != nil {
+			respDump.Modified = true
+			respDump.RawOrig = respOrig.raw(rawBody)
+		}
+
+		record := &models.RequestResponse{
 			Request:  *rDump,
 			Response: *respDump,
-		},
-	)
-	if err != nil {
-		rt.log.Error("error while CreateRequest", sl.Err(err))
+		}
+		record.UpstreamAddr = upstreamAddr
+		setTLSInfo(record, resp.TLS)
+		if hello := clientHelloFrom(r.Context()); hello != nil {
+			record.ClientHello = *hello
+		}
+		if ex, ok := r.Context().Value(exchangeKey{}).(*exchange); ok {
+			ex.record = record
+		}
+		rt.writer.Enqueue("request", func() error {
+			return rt.repo.CreateRequest(record)
+		})
+	}
+
+	// Body of a switched protocol response is the raw upstream connection.
+	if resp.StatusCode == http.StatusSwitchingProtocols || resp.Body == nil {
+		save(nil, false)
+		return resp, nil
 	}
 
-	return resp, err
+	resp.Body = newCaptureBody(resp.Body, rt.bodyLimit, save)
 
+	return resp, nil
+}
+
+// exchangeTimer cancels an upstream exchange running longer than its
+// timeout, a nil timer does nothing.
+type exchangeTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+}
+
+func startExchangeTimer(r *http.Request, timeout time.Duration) (*exchangeTimer, *http.Request) {
+	ctx, cancel := context.WithCancel(r.Context())
+	return &exchangeTimer{
+		timeout: timeout,
+		timer:   time.AfterFunc(timeout, cancel),
+		cancel:  cancel,
+	}, r.WithContext(ctx)
+}
+
+func (t *exchangeTimer) pause() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
+
+func (t *exchangeTimer) resume() {
+	if t != nil {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+// stop ends the exchange.
+func (t *exchangeTimer) stop() {
+	if t != nil {
+		t.timer.Stop()
+		t.cancel()
+	}
+}
+
+// timedBody stops the timer of its exchange once closed. With idle the
+// timer restarts after every read.
+type timedBody struct {
+	io.ReadCloser
+	timer *exchangeTimer
+	idle  bool
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.idle && err == nil {
+		b.timer.resume()
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.timer.stop()
+	return err
+}
+
+// rawMessage joins a header dump with the captured body into a message
+// http.ReadRequest and http.ReadResponse can parse back. The body is
+// already de-chunked and may be truncated, so Transfer-Encoding is dropped
+// and Content-Length is set to its captured size. Heads without a body,
+// e.g. of HEAD responses, are kept as they are.
+func rawMessage(head, body []byte) string {
+	lines := strings.Split(strings.TrimSuffix(string(head), "\r\n\r\n"), "\r\n")
+	chunked := false
+	for _, line := range lines[1:] {
+		name, _, _ := strings.Cut(line, ":")
+		chunked = chunked || strings.EqualFold(name, "Transfer-Encoding")
+	}
+	if len(body) == 0 && !chunked {
+		return string(head)
+	}
+
+	var b strings.Builder
+	for i, line := range lines {
+		name, _, _ := strings.Cut(line, ":")
+		if i > 0 && (strings.EqualFold(name, "Transfer-Encoding") || strings.EqualFold(name, "Content-Length")) {
+			continue
+		}
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	b.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n")
+	b.Write(body)
+	return b.String()
 }
 
 func ParseRequest(r *http.Request) *models.Request {
 	reqD := &models.Request{
 		Method:     r.Method,
+		Proto:      r.Proto,
+		Scheme:     r.URL.Scheme,
 		Path:       r.URL.Path,
 		GetParams:  make(map[string][]string),
 		Headers:    make(map[string][]string),
@@ -157,19 +325,13 @@ func ParseRequest(r *http.Request) *models.Request {
 	}
 	reqD.Cookies = cookies
 
-	if err := r.ParseForm(); err == nil {
-		postFormVals := make(url.Values)
-		for k, values := range r.PostForm {
-			postFormVals[k] = append(postFormVals[k], values...)
-		}
-		reqD.PostParams = postFormVals
-	}
 	return reqD
 }
 
 func ParseResponse(r *http.Response) *models.Response {
 	reqD := &models.Response{
 		StatusCode: r.StatusCode,
+		Proto:      r.Proto,
 		Headers:    make(map[string][]string),
 		Cookies:    make(map[string]string),
 		PostParams: make(map[string][]string),
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/mrdjeb/trueproxy/internal/config"
+)
+
+const dialTimeout = 30 * time.Second
+
+// Upstream makes all outgoing connections: HTTP exchanges through its
+// RoundTrip and raw streams of tunnels through Dial. Both are chained
+// through the upstream proxy and honor host overrides.
+type Upstream struct {
+	*tlsRouter
+
+	dial      dialFunc // direct connection with host overrides
+	proxyURL  *url.URL // nil for direct connections
+	bypass    []string
+	overrides hostOverrides
+}
+
+// NewTransport builds the transport for all outgoing traffic, optionally
+// chained through an upstream HTTP(S) or SOCKS5 proxy, with host address
+// overrides and per-host TLS settings.
+func NewTransport(cfg config.Upstream) (*Upstream, error) {
+	overrides, err := parseHostOverrides(cfg.Hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = originalDstDialer(overrides, overrides.dialer(transport.DialContext))
+	// Upstream that accepts a request and never answers must not hold the
+	// client forever, bodies are bounded by the round tripper.
+	transport.ResponseHeaderTimeout = upstreamTimeout
+	u := &Upstream{
+		tlsRouter: &tlsRouter{def: transport},
+		dial:      transport.DialContext,
+		bypass:    cfg.Bypass,
+		overrides: overrides,
+	}
+	if err := u.setProxy(transport, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.TLSFile == "" {
+		return u, nil
+	}
+
+	rules, err := loadUpstreamTLS(cfg.TLSFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		tlsConfig, err := rule.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		t := transport.Clone()
+		t.TLSClientConfig = tlsConfig
+		u.hosts = append(u.hosts, hostTransport{pattern: rule.Host, transport: t})
+	}
+	return u, nil
+}
+
+// setProxy chains transport through the upstream proxy, overridden hosts
+// are connected directly.
+func (u *Upstream) setProxy(transport *http.Transport, cfg config.Upstream) error {
+	if cfg.URL == "" {
+		return nil
+	}
+
+	proxyURL, err := url.Parse(cfg.URL)
+	if err != nil {
+		return fmt.Errorf("bad upstream proxy url: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case HTTP, HTTPS, "socks5":
+	default:
+		return fmt.Errorf("unsupported upstream proxy scheme %q", proxyURL.Scheme)
+	}
+	if cfg.Username != "" {
+		proxyURL.User = url.UserPassword(cfg.Username, cfg.Password)
+	}
+	u.proxyURL = proxyURL
+
+	transport.Proxy = func(r *http.Request) (*url.URL, error) {
+		if u.direct(r.URL.Hostname()) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}
+	return nil
+}
+
+// direct reports whether host is connected without the upstream proxy.
+func (u *Upstream) direct(host string) bool {
+	return u.proxyURL == nil || matchHost(u.bypass, host) || u.overrides.match(host)
+}
+
+// Dial opens a TCP stream to addr host:port the way the transport would
+// connect to it, through CONNECT of an HTTP upstream proxy or SOCKS5.
+func (u *Upstream) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.direct(host) {
+		return u.dial(ctx, "tcp", addr)
+	}
+
+	if u.proxyURL.Scheme == "socks5" {
+		var auth *proxy.Auth
+		if u.proxyURL.User != nil {
+			password, _ := u.proxyURL.User.Password()
+			auth = &proxy.Auth{User: u.proxyURL.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", u.proxyURL.Host, auth, &net.Dialer{Timeout: dialTimeout})
+		if err != nil {
+			return nil, err
+		}
+		return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	}
+	return u.connect(ctx, addr)
+}
+
+// connect opens a CONNECT tunnel to addr through the HTTP(S) upstream proxy.
+func (u *Upstream) connect(ctx context.Context, addr string) (net.Conn, error) {
+	proxyAddr := u.proxyURL.Host
+	if u.proxyURL.Port() == "" {
+		port := "80"
+		if u.proxyURL.Scheme == HTTPS {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(u.proxyURL.Hostname(), port)
+	}
+
+	d := net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake and CONNECT exchange are bounded like the dial.
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dialTimeout)
+	}
+	conn.SetDeadline(deadline)
+	if u.proxyURL.Scheme == HTTPS {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.proxyURL.User != nil {
+		password, _ := u.proxyURL.User.Password()
+		credentials := u.proxyURL.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy CONNECT %s: %s", addr, resp.Status)
+	}
+	// Body of a successful reply is the tunnel whatever framing headers
+	// say, it must not be drained.
+
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// TLSConfig returns the client config of connections to host with its
+// -upstream-tls settings, if any.
+func (u *Upstream) TLSConfig(host string) *tls.Config {
+	for _, h := range u.hosts {
+		if matchHost([]string{h.pattern}, host) {
+			return h.transport.TLSClientConfig.Clone()
+		}
+	}
+	return &tls.Config{}
+}
+
+// matchHost reports whether host matches any of glob patterns like "*.example.com".
+func matchHost(patterns []string, host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/mrdjeb/trueproxy/internal/models"
+)
+
+// UpstreamTLSRule is a per-host TLS setting of outgoing connections, read
+// from the JSON file given with -upstream-tls.
+type UpstreamTLSRule struct {
+	Host       string   `json:"host"`        // pattern like "*.staging.local"
+	RootCAs    []string `json:"root_cas"`    // PEM files trusted in addition to system roots
+	ClientCert string   `json:"client_cert"` // PEM certificate presented for mTLS
+	ClientKey  string   `json:"client_key"`
+	MinVersion string   `json:"min_version"` // "1.0", "1.1", "1.2" or "1.3"
+	Insecure   bool     `json:"insecure"`    // skip server certificate verification
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// hostTransport is the transport used for hosts matching pattern.
+type hostTransport struct {
+	pattern   string
+	transport *http.Transport
+}
+
+// tlsRouter sends requests through the transport of the first rule matching
+// the target host, others go through the default one.
+type tlsRouter struct {
+	def   *http.Transport
+	hosts []hostTransport
+}
+
+func (t *tlsRouter) RoundTrip(r *http.Request) (*http.Response, error) {
+	host := r.URL.Hostname()
+	for _, h := range t.hosts {
+		if matchHost([]string{h.pattern}, host) {
+			return h.transport.RoundTrip(r)
+		}
+	}
+	return t.def.RoundTrip(r)
+}
+
+// loadUpstreamTLS reads the rules file.
+func loadUpstreamTLS(name string) ([]UpstreamTLSRule, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var rules []UpstreamTLSRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("bad upstream tls file: %w", err)
+	}
+	return rules, nil
+}
+
+// tlsConfig builds the client config of the rule.
+func (rule UpstreamTLSRule) tlsConfig() (*tls.Config, error) {
+	if rule.Host == "" {
+		return nil, errors.New("upstream tls rule without host")
+	}
+
+	config := &tls.Config{
+		InsecureSkipVerify: rule.Insecure,
+	}
+
+	if rule.MinVersion != "" {
+		version, ok := tlsVersions[rule.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown min_version %q", rule.Host, rule.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if len(rule.RootCAs) > 0 {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		for _, name := range rule.RootCAs {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", rule.Host, err)
+			}
+			if !roots.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("%s: no certificates in %s", rule.Host, name)
+			}
+		}
+		config.RootCAs = roots
+	}
+
+	if rule.ClientCert != "" || rule.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(rule.ClientCert, rule.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: client certificate: %w", rule.Host, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// setTLSInfo stores the negotiated upstream TLS parameters in record.
+func setTLSInfo(record *models.RequestResponse, state *tls.ConnectionState) {
+	if state == nil {
+		return
+	}
+	record.UpstreamTLSVersion = tls.VersionName(state.Version)
+	record.UpstreamCipher = tls.CipherSuiteName(state.CipherSuite)
+	if len(state.PeerCertificates) > 0 {
+		fingerprint := sha256.Sum256(state.PeerCertificates[0].Raw)
+		record.UpstreamFingerprint = hex.EncodeToString(fingerprint[:])
+	}
+	record.UpstreamChain = certChain(state.PeerCertificates)
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"github.com/mrdjeb/trueproxy/internal/logger/sl"
+	"github.com/mrdjeb/trueproxy/internal/models"
+	"github.com/mrdjeb/trueproxy/internal/writequeue"
+)
+
+// maxFramePayload limits how much of a single frame payload is stored.
+const maxFramePayload = 64 << 10
+
+func isWebSocketUpgrade(h http.Header) bool {
+	if !strings.EqualFold(h.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, f := range h["Connection"] {
+		for _, sf := range strings.Split(f, ",") {
+			if strings.EqualFold(strings.TrimSpace(sf), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleWebSocket forwards the upgrade handshake and, once upstream switches
+// protocols, tunnels frames between client and upstream recording each of them.
+func (p *ProxyHandler) handleWebSocket(log *slog.Logger, clientConn net.Conn, clientReader io.Reader, inReq *http.Request, proto string) {
+	ex := &exchange{}
+	inReq = inReq.WithContext(withExchange(inReq.Context(), ex))
+
+	resp, err := p.roundTrip(inReq, proto)
+	if err != nil {
+		log.Error("websocket handshake error", sl.Err(err))
+		writeRawClientResponse(log, inReq, clientConn, http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = inReq.Proto, inReq.ProtoMajor, inReq.ProtoMinor
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		responseDump, err := httputil.DumpResponse(resp, true)
+		if err != nil {
+			log.Error("error while dump response", sl.Err(err))
+			return
+		}
+		if _, err := clientConn.Write(responseDump); err != nil {
+			log.Error("error writing response back to client connection", sl.Err(err))
+		}
+		return
+	}
+
+	upstreamConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		log.Error("upstream switched protocols without writable body")
+		return
+	}
+
+	resp.Body = nil
+	if err := resp.Write(clientConn); err != nil {
+		log.Error("error writing handshake back to client connection", sl.Err(err))
+		return
+	}
+	resp.Body = upstreamConn
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- copyFrames(upstreamConn, clientReader, p.frameRecorder(ex.record, models.FrameFromClient))
+	}()
+	go func() {
+		errc <- copyFrames(clientConn, upstreamConn, p.frameRecorder(ex.record, models.FrameFromServer))
+	}()
+
+	if err := <-errc; err != nil && err != io.EOF {
+		log.Debug("websocket tunnel closed", sl.Err(err))
+	}
+	upstreamConn.Close()
+	clientConn.Close()
+	<-errc
+}
+
+// frameRecorder queues frames of the handshake record. The record is
+// queued before them, so its ID is known by the time a frame is written.
+func (p *ProxyHandler) frameRecorder(record *models.RequestResponse, direction string) func(*models.WebSocketFrame) {
+	return func(frame *models.WebSocketFrame) {
+		if record == nil {
+			return
+		}
+		frame.Direction = direction
+		p.writer.Enqueue("frame", func() error {
+			// Frames of a record that failed to store are skipped.
+			if record.ID == 0 {
+				return writequeue.ErrSkip
+			}
+			frame.RequestResponseID = record.ID
+			return p.repo.CreateFrame(frame)
+		})
+	}
+}
+
+// copyFrames copies WebSocket frames from src to dst byte for byte and
+// reports every frame with its unmasked payload to onFrame.
+func copyFrames(dst io.Writer, src io.Reader, onFrame func(*models.WebSocketFrame)) error {
+	br, ok := src.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(src)
+	}
+
+	var header [14]byte
+	for {
+		if _, err := io.ReadFull(br, header[:2]); err != nil {
+			return err
+		}
+		ts := time.Now()
+		n := 2
+
+		fin := header[0]&0x80 != 0
+		opcode := int(header[0] & 0x0f)
+		masked := header[1]&0x80 != 0
+
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			if _, err := io.ReadFull(br, header[n:n+2]); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(header[n : n+2]))
+			n += 2
+		case 127:
+			if _, err := io.ReadFull(br, header[n:n+8]); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(header[n : n+8])
+			n += 8
+		}
+
+		var maskKey []byte
+		if masked {
+			if _, err := io.ReadFull(br, header[n:n+4]); err != nil {
+				return err
+			}
+			maskKey = header[n : n+4]
+			n += 4
+		}
+
+		if _, err := dst.Write(header[:n]); err != nil {
+			return err
+		}
+
+		payload := &limitedBuffer{limit: maxFramePayload}
+		if _, err := io.CopyN(io.MultiWriter(dst, payload), br, int64(length)); err != nil {
+			return err
+		}
+
+		data := payload.Bytes()
+		if masked {
+			for i := range data {
+				data[i] ^= maskKey[i%4]
+			}
+		}
+
+		onFrame(&models.WebSocketFrame{
+			Fin:       fin,
+			Opcode:    opcode,
+			Length:    int64(length),
+			Payload:   string(data),
+			Truncated: payload.Truncated(),
+			Timestamp: ts,
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp     // comparison operator
+	tokAnd    // && or "and"
+	tokOr     // || or "or"
+	tokNot    // ! or "not"
+	tokExists // "exists"
+	tokTrue
+	tokFalse
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+)
+
+type token struct {
+	kind tokenKind
+	text string // source text, unquoted for strings
+	pos  int    // 1-based
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+var keywords = map[string]tokenKind{
+	"and":    tokAnd,
+	"or":     tokOr,
+	"not":    tokNot,
+	"exists": tokExists,
+	"true":   tokTrue,
+	"false":  tokFalse,
+}
+
+// lex splits src into tokens.
+func lex(src string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(src) {
+		r, size := utf8.DecodeRuneInString(src[i:])
+		pos := utf8.RuneCountInString(src[:i]) + 1
+
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+			continue
+
+		case r == '"':
+			s, n, err := lexString(src[i:], pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokString, text: s, pos: pos})
+			i += n
+			continue
+
+		case r >= '0' && r <= '9' || r == '-' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := i + 1
+			for j < len(src) && src[j] >= '0' && src[j] <= '9' {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[i:j], pos: pos})
+			i = j
+			continue
+
+		case r == '_' || unicode.IsLetter(r):
+			j := i
+			for j < len(src) {
+				r, size := utf8.DecodeRuneInString(src[j:])
+				if r != '_' && r != '.' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				j += size
+			}
+			word := src[i:j]
+			kind, ok := keywords[strings.ToLower(word)]
+			if !ok {
+				kind = tokIdent
+			}
+			tokens = append(tokens, token{kind: kind, text: word, pos: pos})
+			i = j
+			continue
+		}
+
+		op, kind := lexOperator(src[i:])
+		if op == "" {
+			return nil, &Error{Pos: pos, Msg: fmt.Sprintf("unexpected character %q", r)}
+		}
+		tokens = append(tokens, token{kind: kind, text: op, pos: pos})
+		i += len(op)
+	}
+	pos := utf8.RuneCountInString(src) + 1
+	return append(tokens, token{kind: tokEOF, pos: pos}), nil
+}
+
+var operators = []struct {
+	text string
+	kind tokenKind
+}{
+	// Longer operators go first.
+	{"&&", tokAnd},
+	{"||", tokOr},
+	{"==", tokOp},
+	{"!=", tokOp},
+	{"!~", tokOp},
+	{"<=", tokOp},
+	{">=", tokOp},
+	{"=", tokOp},
+	{"~", tokOp},
+	{"<", tokOp},
+	{">", tokOp},
+	{"!", tokNot},
+	{"(", tokLParen},
+	{")", tokRParen},
+	{"[", tokLBracket},
+	{"]", tokRBracket},
+}
+
+func lexOperator(s string) (string, tokenKind) {
+	for _, op := range operators {
+		if strings.HasPrefix(s, op.text) {
+			return op.text, op.kind
+		}
+	}
+	return "", tokEOF
+}
+
+// lexString reads a double quoted string with Go escapes, it returns the
+// value and the number of bytes consumed.
+func lexString(s string, pos int) (string, int, error) {
+	escaped := false
+	for i := 1; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			value, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", 0, &Error{Pos: pos, Msg: "bad escape in string"}
+			}
+			return value, i + 1, nil
+		}
+	}
+	return "", 0, &Error{Pos: pos, Msg: "unterminated string"}
+}
@@ -0,0 +1,280 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Error is a parse failure at 1-based character position Pos of the query.
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("position %d: %s", e.Pos, e.Msg)
+}
+
+// Errorf returns an Error at the position of node.
+func Errorf(node Node, format string, args ...any) *Error {
+	return &Error{Pos: node.Pos(), Msg: fmt.Sprintf(format, args...)}
+}
+
+// Node is an element of a parsed query.
+type Node interface {
+	Pos() int
+}
+
+// Expr is a boolean expression.
+type Expr interface {
+	Node
+	expr()
+}
+
+// Binary is X && Y or X || Y, Op is "&&" or "||".
+type Binary struct {
+	Op   string
+	X, Y Expr
+	pos  int
+}
+
+// Not negates X.
+type Not struct {
+	X   Expr
+	pos int
+}
+
+// Compare is Field Op Value, Op is one of == != < <= > >= ~ !~.
+type Compare struct {
+	Field Field
+	Op    string
+	Value Value
+	pos   int
+}
+
+// Exists checks that Field is present, used with keyed fields.
+type Exists struct {
+	Field Field
+	pos   int
+}
+
+// Field is a name like "resp.status", optionally with a key as in
+// req.header["Authorization"].
+type Field struct {
+	Name   string
+	Key    string
+	HasKey bool
+	pos    int
+}
+
+type ValueKind int
+
+const (
+	String ValueKind = iota
+	Number
+	Bool
+)
+
+func (k ValueKind) String() string {
+	switch k {
+	case Number:
+		return "number"
+	case Bool:
+		return "boolean"
+	}
+	return "string"
+}
+
+// Value is a literal.
+type Value struct {
+	Kind ValueKind
+	Str  string
+	Num  int64
+	Bool bool
+	pos  int
+}
+
+func (b *Binary) Pos() int  { return b.pos }
+func (n *Not) Pos() int     { return n.pos }
+func (c *Compare) Pos() int { return c.pos }
+func (e *Exists) Pos() int  { return e.pos }
+func (f Field) Pos() int    { return f.pos }
+func (v Value) Pos() int    { return v.pos }
+
+func (*Binary) expr()  {}
+func (*Not) expr()     {}
+func (*Compare) expr() {}
+func (*Exists) expr()  {}
+
+// Parse parses a search expression over captured traffic, e.g.
+//
+//	host ~ "api" && resp.status >= 500 && req.header["Authorization"] exists
+//
+// Comparisons are combined with &&, || and ! ("and", "or" and "not" work
+// too). Field names are not checked, translating them is up to the caller.
+func Parse(src string) (Expr, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	if p.peek().kind == tokEOF {
+		return nil, &Error{Pos: 1, Msg: "empty query"}
+	}
+
+	x, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf("unexpected %s, expected && or ||", t)}
+	}
+	return x, nil
+}
+
+type parser struct {
+	tokens []token
+	i      int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, &Error{Pos: t.pos, Msg: fmt.Sprintf("expected %s, got %s", what, t)}
+	}
+	return t, nil
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOr {
+		op := p.next()
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		x = &Binary{Op: "||", X: x, Y: y, pos: op.pos}
+	}
+	return x, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokAnd {
+		op := p.next()
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		x = &Binary{Op: "&&", X: x, Y: y, pos: op.pos}
+	}
+	return x, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	switch t := p.peek(); t.kind {
+	case tokNot:
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{X: x, pos: t.pos}, nil
+
+	case tokLParen:
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRParen, ")"); err != nil {
+			return nil, err
+		}
+		return x, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (Expr, error) {
+	field, err := p.parseField()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.next()
+	switch t.kind {
+	case tokExists:
+		return &Exists{Field: field, pos: field.pos}, nil
+	case tokOp:
+	default:
+		return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf("expected operator or exists after %s, got %s", field.Name, t)}
+	}
+
+	op := t.text
+	if op == "=" {
+		op = "=="
+	}
+
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return &Compare{Field: field, Op: op, Value: value, pos: field.pos}, nil
+}
+
+func (p *parser) parseField() (Field, error) {
+	t, err := p.expect(tokIdent, "field name")
+	if err != nil {
+		return Field{}, err
+	}
+	field := Field{Name: t.text, pos: t.pos}
+
+	if p.peek().kind != tokLBracket {
+		return field, nil
+	}
+	p.next()
+	key, err := p.expect(tokString, "quoted key")
+	if err != nil {
+		return Field{}, err
+	}
+	if _, err := p.expect(tokRBracket, "]"); err != nil {
+		return Field{}, err
+	}
+	field.Key, field.HasKey = key.text, true
+	return field, nil
+}
+
+func (p *parser) parseValue() (Value, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return Value{Kind: String, Str: t.text, pos: t.pos}, nil
+	case tokNumber:
+		n, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return Value{}, &Error{Pos: t.pos, Msg: fmt.Sprintf("bad number %s", t.text)}
+		}
+		return Value{Kind: Number, Num: n, pos: t.pos}, nil
+	case tokTrue, tokFalse:
+		return Value{Kind: Bool, Bool: t.kind == tokTrue, pos: t.pos}, nil
+	}
+	return Value{}, &Error{Pos: t.pos, Msg: fmt.Sprintf("expected value, got %s", t)}
+}
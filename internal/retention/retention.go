@@ -0,0 +1,73 @@
+package retention
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/mrdjeb/trueproxy/internal/config"
+	"github.com/mrdjeb/trueproxy/internal/logger/sl"
+	"github.com/mrdjeb/trueproxy/internal/storage"
+)
+
+type Purger interface {
+	PurgeRequests(storage.RetentionPolicy) (int64, error)
+	Vacuum() error
+}
+
+// Worker periodically deletes requests beyond the retention limits and
+// reclaims their space.
+type Worker struct {
+	log      *slog.Logger
+	purger   Purger
+	policy   storage.RetentionPolicy
+	interval time.Duration
+}
+
+func New(log *slog.Logger, purger Purger, cfg config.Retention) *Worker {
+	return &Worker{
+		log:    log.With(slog.String("op", "retention.Worker")),
+		purger: purger,
+		policy: storage.RetentionPolicy{
+			MaxAge:       cfg.MaxAge,
+			MaxRows:      cfg.MaxRows,
+			MaxBodyBytes: cfg.MaxBodyBytes,
+		},
+		interval: cfg.Interval,
+	}
+}
+
+// Enabled reports whether any limit is set.
+func (w *Worker) Enabled() bool {
+	return w.policy != storage.RetentionPolicy{} && w.interval > 0
+}
+
+// Run purges at startup and then every interval until stop is closed.
+func (w *Worker) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		w.purge()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Worker) purge() {
+	deleted, err := w.purger.PurgeRequests(w.policy)
+	if err != nil {
+		w.log.Error("failed to purge requests", sl.Err(err))
+		return
+	}
+	if deleted == 0 {
+		return
+	}
+	if err := w.purger.Vacuum(); err != nil {
+		w.log.Error("failed to vacuum", sl.Err(err))
+		return
+	}
+	w.log.Info("purged requests", slog.Int64("count", deleted))
+}
@@ -0,0 +1,248 @@
+package rewrite
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/mrdjeb/trueproxy/internal/logger/sl"
+	"github.com/mrdjeb/trueproxy/internal/models"
+	"github.com/mrdjeb/trueproxy/internal/storage"
+	"gorm.io/gorm"
+)
+
+const (
+	StageRequest  = "request"
+	StageResponse = "response"
+)
+
+// ErrBadRule wraps the reason a rule can not be compiled.
+var ErrBadRule = errors.New("bad rewrite rule")
+
+// Rule is a stored rewrite rule ready for matching.
+type Rule struct {
+	models.RewriteRule
+
+	path  *regexp.Regexp
+	match *regexp.Regexp
+}
+
+func compile(rule models.RewriteRule) (Rule, error) {
+	compiled, err := compileRule(rule)
+	if err != nil {
+		return Rule{}, fmt.Errorf("%w: %w", ErrBadRule, err)
+	}
+	return compiled, nil
+}
+
+func compileRule(rule models.RewriteRule) (Rule, error) {
+	switch rule.Stage {
+	case StageRequest, StageResponse:
+	case "":
+		rule.Stage = StageRequest
+	default:
+		return Rule{}, fmt.Errorf("unknown stage %q", rule.Stage)
+	}
+
+	switch rule.Type {
+	case models.RewriteHeaderAdd, models.RewriteHeaderRemove, models.RewriteHeaderReplace:
+		if rule.Header == "" {
+			return Rule{}, fmt.Errorf("header is required for %s", rule.Type)
+		}
+	case models.RewriteBody:
+		if rule.Match == "" {
+			return Rule{}, fmt.Errorf("match is required for %s", rule.Type)
+		}
+	case models.RewriteStatus:
+		if rule.Stage != StageResponse {
+			return Rule{}, fmt.Errorf("%s works only on response stage", rule.Type)
+		}
+		if rule.Status < 100 || rule.Status > 999 {
+			return Rule{}, fmt.Errorf("bad status %d", rule.Status)
+		}
+	default:
+		return Rule{}, fmt.Errorf("unknown type %q", rule.Type)
+	}
+
+	if rule.Host != "" {
+		if _, err := path.Match(rule.Host, ""); err != nil {
+			return Rule{}, fmt.Errorf("bad host pattern: %w", err)
+		}
+	}
+
+	compiled := Rule{RewriteRule: rule}
+	var err error
+	if rule.Path != "" {
+		if compiled.path, err = regexp.Compile(rule.Path); err != nil {
+			return Rule{}, fmt.Errorf("bad path regexp: %w", err)
+		}
+	}
+	if rule.Match != "" {
+		if compiled.match, err = regexp.Compile(rule.Match); err != nil {
+			return Rule{}, fmt.Errorf("bad match regexp: %w", err)
+		}
+	}
+	return compiled, nil
+}
+
+func (r *Rule) matches(stage, method, host, urlPath string) bool {
+	if r.Disabled || r.Stage != stage {
+		return false
+	}
+	if r.Method != "" && !strings.EqualFold(r.Method, method) {
+		return false
+	}
+	if r.Host != "" {
+		if ok, _ := path.Match(strings.ToLower(r.Host), strings.ToLower(host)); !ok {
+			return false
+		}
+	}
+	return r.path == nil || r.path.MatchString(urlPath)
+}
+
+// ApplyHeader runs header_* rules on h and reports whether it changed.
+func (r *Rule) ApplyHeader(h http.Header) bool {
+	switch r.Type {
+	case models.RewriteHeaderAdd:
+		h.Add(r.Header, r.Replace)
+		return true
+	case models.RewriteHeaderRemove:
+		if _, ok := h[http.CanonicalHeaderKey(r.Header)]; !ok {
+			return false
+		}
+		h.Del(r.Header)
+		return true
+	case models.RewriteHeaderReplace:
+		values := h.Values(r.Header)
+		if len(values) == 0 {
+			return false
+		}
+		changed := false
+		replaced := make([]string, len(values))
+		for i, v := range values {
+			replaced[i] = r.Replace
+			if r.match != nil {
+				replaced[i] = r.match.ReplaceAllString(v, r.Replace)
+			}
+			changed = changed || replaced[i] != v
+		}
+		h[http.CanonicalHeaderKey(r.Header)] = replaced
+		return changed
+	}
+	return false
+}
+
+// ApplyBody runs a body rule, $1 style references are expanded in Replace.
+func (r *Rule) ApplyBody(body []byte) []byte {
+	if r.Type != models.RewriteBody || r.match == nil {
+		return body
+	}
+	return r.match.ReplaceAll(body, []byte(r.Replace))
+}
+
+// Engine keeps rewrite rules from storage compiled in memory. Rules are
+// changed only through it so the cache never goes stale.
+type Engine struct {
+	log  *slog.Logger
+	repo storage.RewriteRepo
+
+	edit  sync.Mutex // serializes changes of rules with their reload
+	mu    sync.RWMutex
+	rules []Rule
+}
+
+func New(log *slog.Logger, repo storage.RewriteRepo) (*Engine, error) {
+	e := &Engine{log: log, repo: repo}
+	if err := e.reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Engine) reload() error {
+	stored, err := e.repo.ReadRewriteRules()
+	if err != nil {
+		return err
+	}
+
+	rules := make([]Rule, 0, len(stored))
+	for _, rule := range stored {
+		compiled, err := compile(rule)
+		if err != nil {
+			// Stored rules were validated once, skip the one broken by hand.
+			e.log.Warn("rewrite rule skipped", slog.Uint64("id", uint64(rule.ID)), sl.Err(err))
+			continue
+		}
+		rules = append(rules, compiled)
+	}
+
+	e.mu.Lock()
+	e.rules = rules
+	e.mu.Unlock()
+	return nil
+}
+
+// Match returns enabled rules for the message in the order they were created.
+func (e *Engine) Match(stage, method, host, urlPath string) []Rule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var matched []Rule
+	for i := range e.rules {
+		if e.rules[i].matches(stage, method, host, urlPath) {
+			matched = append(matched, e.rules[i])
+		}
+	}
+	return matched
+}
+
+func (e *Engine) Rules() ([]models.RewriteRule, error) {
+	return e.repo.ReadRewriteRules()
+}
+
+func (e *Engine) AddRule(rule models.RewriteRule) (models.RewriteRule, error) {
+	compiled, err := compile(rule)
+	if err != nil {
+		return models.RewriteRule{}, err
+	}
+	rule = compiled.RewriteRule
+	rule.Model = gorm.Model{}
+
+	e.edit.Lock()
+	defer e.edit.Unlock()
+	if err := e.repo.CreateRewriteRule(&rule); err != nil {
+		return models.RewriteRule{}, err
+	}
+	return rule, e.reload()
+}
+
+func (e *Engine) UpdateRule(id uint, rule models.RewriteRule) (models.RewriteRule, error) {
+	compiled, err := compile(rule)
+	if err != nil {
+		return models.RewriteRule{}, err
+	}
+	rule = compiled.RewriteRule
+	rule.Model = gorm.Model{}
+	rule.ID = id
+
+	e.edit.Lock()
+	defer e.edit.Unlock()
+	if err := e.repo.UpdateRewriteRule(&rule); err != nil {
+		return models.RewriteRule{}, err
+	}
+	return rule, e.reload()
+}
+
+func (e *Engine) DeleteRule(id uint) error {
+	e.edit.Lock()
+	defer e.edit.Unlock()
+	if err := e.repo.DeleteRewriteRule(id); err != nil {
+		return err
+	}
+	return e.reload()
+}
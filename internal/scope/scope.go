@@ -0,0 +1,346 @@
+package scope
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mrdjeb/trueproxy/internal/logger/sl"
+	"github.com/mrdjeb/trueproxy/internal/models"
+	"github.com/mrdjeb/trueproxy/internal/storage"
+	"gorm.io/gorm"
+)
+
+// Actions for out of scope traffic.
+const (
+	ActionForward = "forward" // intercept as usual but do not store
+	ActionTunnel  = "tunnel"  // splice TLS connections without MITM when possible
+)
+
+// ErrBadRule wraps the reason a rule can not be compiled.
+var ErrBadRule = errors.New("bad scope rule")
+
+type rule struct {
+	models.ScopeRule
+
+	path *regexp.Regexp
+}
+
+func compile(scopeRule models.ScopeRule) (rule, error) {
+	compiled, err := compileRule(scopeRule)
+	if err != nil {
+		return rule{}, fmt.Errorf("%w: %w", ErrBadRule, err)
+	}
+	return compiled, nil
+}
+
+func compileRule(scopeRule models.ScopeRule) (rule, error) {
+	scopeRule.Scheme = strings.ToLower(scopeRule.Scheme)
+	switch scopeRule.Scheme {
+	case "", "http", "https":
+	default:
+		return rule{}, fmt.Errorf("unknown scheme %q", scopeRule.Scheme)
+	}
+	if scopeRule.Port < 0 || scopeRule.Port > 65535 {
+		return rule{}, fmt.Errorf("bad port %d", scopeRule.Port)
+	}
+	if scopeRule.Host != "" {
+		if _, err := path.Match(scopeRule.Host, ""); err != nil {
+			return rule{}, fmt.Errorf("bad host pattern: %w", err)
+		}
+	}
+	if scopeRule.ContentType != "" {
+		if _, err := path.Match(scopeRule.ContentType, ""); err != nil {
+			return rule{}, fmt.Errorf("bad content type pattern: %w", err)
+		}
+	}
+
+	compiled := rule{ScopeRule: scopeRule}
+	if scopeRule.Path != "" {
+		re, err := regexp.Compile(scopeRule.Path)
+		if err != nil {
+			return rule{}, fmt.Errorf("bad path regexp: %w", err)
+		}
+		compiled.path = re
+	}
+	return compiled, nil
+}
+
+// Target is what is known about a message when scope is checked. Path and
+// ContentType are empty before the request is decrypted.
+type Target struct {
+	Scheme      string
+	Host        string
+	Port        int
+	Path        string
+	ContentType string
+}
+
+// matchesConn checks only connection level fields of the rule.
+func (r *rule) matchesConn(t Target) bool {
+	if r.Scheme != "" && r.Scheme != t.Scheme {
+		return false
+	}
+	if r.Port != 0 && r.Port != t.Port {
+		return false
+	}
+	if r.Host != "" {
+		if ok, _ := path.Match(strings.ToLower(r.Host), strings.ToLower(t.Host)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *rule) matches(t Target) bool {
+	if !r.matchesConn(t) {
+		return false
+	}
+	if r.path != nil && !r.path.MatchString(t.Path) {
+		return false
+	}
+	if r.ContentType != "" {
+		mediaType, _, _ := mime.ParseMediaType(t.ContentType)
+		if ok, _ := path.Match(strings.ToLower(r.ContentType), mediaType); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// connOnly reports whether the rule can be decided before decryption.
+func (r *rule) connOnly() bool {
+	return r.path == nil && r.ContentType == ""
+}
+
+// Scope decides which traffic belongs to the project. Without include rules
+// everything is in scope, exclude rules always win.
+type Scope struct {
+	log    *slog.Logger
+	repo   storage.ScopeRepo
+	action string
+	// rescan asks Run to recompute OutOfScope of stored records, edits in
+	// a row are coalesced into one pass.
+	rescan chan struct{}
+
+	edit  sync.Mutex // serializes changes of rules
+	rules []rule     // in the order they were created
+
+	mu       sync.RWMutex
+	includes []rule
+	excludes []rule
+}
+
+func New(log *slog.Logger, repo storage.ScopeRepo, action string) (*Scope, error) {
+	switch action {
+	case ActionForward, ActionTunnel:
+	default:
+		return nil, fmt.Errorf("unknown out of scope action %q", action)
+	}
+
+	s := &Scope{log: log, repo: repo, action: action, rescan: make(chan struct{}, 1)}
+	stored, err := repo.ReadScopeRules()
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]rule, 0, len(stored))
+	for _, scopeRule := range stored {
+		compiled, err := compile(scopeRule)
+		if err != nil {
+			// Stored rules were validated once, skip the one broken by hand.
+			log.Warn("scope rule skipped", slog.Uint64("id", uint64(scopeRule.ID)), sl.Err(err))
+			continue
+		}
+		rules = append(rules, compiled)
+	}
+	s.set(rules)
+	return s, nil
+}
+
+// Run recomputes OutOfScope of stored records once at start and after every
+// change of rules until stop is closed.
+func (s *Scope) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.rescan:
+		}
+
+		err := s.repo.MarkOutOfScope(func(record *models.RequestResponse) bool {
+			return !s.InScope(RecordTarget(record))
+		})
+		if err != nil {
+			s.log.Error("failed to mark out of scope records", sl.Err(err))
+		}
+	}
+}
+
+// set replaces the rules in use and schedules a rescan of stored records.
+func (s *Scope) set(rules []rule) {
+	var includes, excludes []rule
+	for _, r := range rules {
+		if r.Exclude {
+			excludes = append(excludes, r)
+		} else {
+			includes = append(includes, r)
+		}
+	}
+	s.rules = rules
+	s.mu.Lock()
+	s.includes, s.excludes = includes, excludes
+	s.mu.Unlock()
+
+	select {
+	case s.rescan <- struct{}{}:
+	default:
+	}
+}
+
+// InScope reports whether a complete exchange belongs to the scope.
+func (s *Scope) InScope(t Target) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i := range s.excludes {
+		if s.excludes[i].matches(t) {
+			return false
+		}
+	}
+	if len(s.includes) == 0 {
+		return true
+	}
+	for i := range s.includes {
+		if s.includes[i].matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tunnel reports whether a connection to the target should be spliced
+// without MITM: tunnel action is on and no request on it can be in scope.
+func (s *Scope) Tunnel(t Target) bool {
+	if s.action != ActionTunnel {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i := range s.excludes {
+		if s.excludes[i].connOnly() && s.excludes[i].matchesConn(t) {
+			return true
+		}
+	}
+	if len(s.includes) == 0 {
+		return false
+	}
+	for i := range s.includes {
+		if s.includes[i].matchesConn(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// HostTarget splits host:port, the port defaults to the scheme one.
+func HostTarget(scheme, hostport string) Target {
+	t := Target{Scheme: scheme, Host: hostport}
+	if host, port, err := net.SplitHostPort(hostport); err == nil {
+		t.Host = host
+		t.Port, _ = strconv.Atoi(port)
+	}
+	if t.Port == 0 {
+		switch scheme {
+		case "http":
+			t.Port = 80
+		case "https":
+			t.Port = 443
+		}
+	}
+	return t
+}
+
+// RecordTarget builds a target from a stored exchange.
+func RecordTarget(record *models.RequestResponse) Target {
+	t := HostTarget(record.Request.Scheme, record.Request.Host)
+	t.Path = record.Request.Path
+	if values := record.Response.Headers["Content-Type"]; len(values) > 0 {
+		t.ContentType = values[0]
+	}
+	return t
+}
+
+func (s *Scope) Rules() ([]models.ScopeRule, error) {
+	return s.repo.ReadScopeRules()
+}
+
+// AddRule stores a valid rule and puts it in use.
+func (s *Scope) AddRule(scopeRule models.ScopeRule) (models.ScopeRule, error) {
+	compiled, err := compile(scopeRule)
+	if err != nil {
+		return models.ScopeRule{}, err
+	}
+	scopeRule = compiled.ScopeRule
+	scopeRule.Model = gorm.Model{}
+
+	s.edit.Lock()
+	defer s.edit.Unlock()
+
+	if err := s.repo.CreateScopeRule(&scopeRule); err != nil {
+		return models.ScopeRule{}, err
+	}
+	compiled.ScopeRule = scopeRule
+	s.set(append(slices.Clone(s.rules), compiled))
+	return scopeRule, nil
+}
+
+func (s *Scope) UpdateRule(id uint, scopeRule models.ScopeRule) (models.ScopeRule, error) {
+	compiled, err := compile(scopeRule)
+	if err != nil {
+		return models.ScopeRule{}, err
+	}
+	scopeRule = compiled.ScopeRule
+	scopeRule.Model = gorm.Model{}
+	scopeRule.ID = id
+
+	s.edit.Lock()
+	defer s.edit.Unlock()
+
+	if err := s.repo.UpdateScopeRule(&scopeRule); err != nil {
+		return models.ScopeRule{}, err
+	}
+	compiled.ScopeRule = scopeRule
+	rules := slices.Clone(s.rules)
+	if i := slices.IndexFunc(rules, func(r rule) bool { return r.ID == id }); i >= 0 {
+		rules[i] = compiled
+	} else {
+		// The stored rule was skipped at load, now it is fixed.
+		rules = append(rules, compiled)
+		slices.SortFunc(rules, func(a, b rule) int { return cmp.Compare(a.ID, b.ID) })
+	}
+	s.set(rules)
+	return scopeRule, nil
+}
+
+func (s *Scope) DeleteRule(id uint) error {
+	s.edit.Lock()
+	defer s.edit.Unlock()
+
+	if err := s.repo.DeleteScopeRule(id); err != nil {
+		return err
+	}
+	s.set(slices.DeleteFunc(slices.Clone(s.rules), func(r rule) bool { return r.ID == id }))
+	return nil
+}
@@ -2,18 +2,73 @@ package storage
 
 import (
 	"errors"
+	"time"
 
 	"github.com/mrdjeb/trueproxy/internal/models"
 )
 
 var (
-	ErrRequestNotFound = errors.New("request not found")
+	ErrRequestNotFound   = errors.New("request not found")
+	ErrRuleNotFound      = errors.New("rule not found")
+	ErrBadFilter         = errors.New("bad filter")
+	ErrSearchUnavailable = errors.New("full-text search unavailable, build with -tags sqlite_fts5")
+)
+
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
 )
 
 type RequestsRepo interface {
 	CreateRequest(*models.RequestResponse) error
 	ReadRequest(uint) (models.RequestResponse, error)
-	ReadAllRequest() ([]models.RequestResponse, error)
+	ListRequests(RequestFilter) ([]models.RequestSummary, error)
+	SearchRequests(text string, limit, offset int) ([]models.SearchResult, error)
+	DeleteRequest(uint) error
+	DeleteRequests(RequestFilter) (int64, error)
+	PurgeRequests(RetentionPolicy) (int64, error)
+	Vacuum() error
+	CreateFrame(*models.WebSocketFrame) error
+	ReadFrames(uint) ([]models.WebSocketFrame, error)
+	CreateTunnel(*models.Tunnel) error
+	ReadTunnels() ([]models.Tunnel, error)
+}
+
+// RequestFilter narrows and pages ListRequests, zero value returns the first
+// DefaultPageSize requests.
+type RequestFilter struct {
+	InScope     bool
+	SNI         string // ClientHello server name
+	JA3         string // MD5 JA3 fingerprint of the client
+	JA4         string
+	Host        string // "*" matches any part, e.g. "*.example.com", port is ignored
+	Method      string
+	StatusMin   int // inclusive, 0 for any
+	StatusMax   int
+	Path        string // substring
+	Since       time.Time
+	Until       time.Time
+	ContentType string // response Content-Type prefix, e.g. "application/json"
+	Query       string // search expression, see query.Parse
+
+	Sort   string // column with optional "-" for descending: id, time, host, method, status, path
+	Limit  int    // DefaultPageSize if zero, at most MaxPageSize
+	Offset int
+	Cursor uint // ID of the last request of the previous page, for id and time sort only
+}
+
+// RetentionPolicy limits stored requests, zero fields are unlimited.
+type RetentionPolicy struct {
+	MaxAge       time.Duration
+	MaxRows      int64
+	MaxBodyBytes int64 // request and response bodies together
+}
+
+type RewriteRepo interface {
+	CreateRewriteRule(*models.RewriteRule) error
+	ReadRewriteRules() ([]models.RewriteRule, error)
+	UpdateRewriteRule(*models.RewriteRule) error
+	DeleteRewriteRule(uint) error
 }
 
 /*
@@ -22,3 +77,12 @@ type RequestsRepo interface {
 /repeat/id – повторная отправка запроса
 /scan/id – сканирование запроса)
 */
+
+type ScopeRepo interface {
+	CreateScopeRule(*models.ScopeRule) error
+	ReadScopeRules() ([]models.ScopeRule, error)
+	UpdateScopeRule(*models.ScopeRule) error
+	DeleteScopeRule(uint) error
+	// MarkOutOfScope recomputes OutOfScope of every stored record.
+	MarkOutOfScope(outOfScope func(*models.RequestResponse) bool) error
+}
@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/mrdjeb/trueproxy/internal/query"
+)
+
+type queryFieldKind int
+
+const (
+	fieldString queryFieldKind = iota
+	fieldNumber
+	fieldBool
+	fieldTime
+	fieldHeaders // JSON map of value lists, keys are canonical header names
+	fieldMap     // JSON map of value lists
+	fieldCookies // JSON map of single values
+)
+
+type queryField struct {
+	column string
+	kind   queryFieldKind
+}
+
+// queryFields are the names usable in search queries.
+var queryFields = map[string]queryField{
+	"id":            {"id", fieldNumber},
+	"time":          {"created_at", fieldTime},
+	"method":        {"method", fieldString},
+	"req.method":    {"method", fieldString},
+	"scheme":        {"scheme", fieldString},
+	"req.scheme":    {"scheme", fieldString},
+	"host":          {"host", fieldString},
+	"req.host":      {"host", fieldString},
+	"path":          {"path", fieldString},
+	"req.path":      {"path", fieldString},
+	"req.proto":     {"proto", fieldString},
+	"req.body":      {"body", fieldString},
+	"req.modified":  {"modified", fieldBool},
+	"req.header":    {"headers", fieldHeaders},
+	"req.param":     {"get_params", fieldMap},
+	"req.post":      {"post_params", fieldMap},
+	"req.cookie":    {"cookies", fieldCookies},
+	"status":        {"Response_StatusCode", fieldNumber},
+	"resp.status":   {"Response_StatusCode", fieldNumber},
+	"resp.proto":    {"Response_Proto", fieldString},
+	"resp.body":     {"Response_Body", fieldString},
+	"resp.modified": {"Response_Modified", fieldBool},
+	"resp.header":   {"Response_Headers", fieldHeaders},
+	"resp.cookie":   {"Response_Cookies", fieldCookies},
+	"content_type":  {contentTypeColumn, fieldString},
+	"out_of_scope":  {"out_of_scope", fieldBool},
+	"sni":           {"client_sni", fieldString},
+	"ja3":           {"client_ja3_hash", fieldString},
+	"ja4":           {"client_ja4", fieldString},
+	"tls.version":   {"upstream_tls_version", fieldString},
+	"tls.cipher":    {"upstream_cipher", fieldString},
+	"upstream.addr": {"upstream_addr", fieldString},
+}
+
+var sqlOperators = map[string]string{
+	"==": "=",
+	"!=": "!=",
+	"<":  "<",
+	"<=": "<=",
+	">":  ">",
+	">=": ">=",
+}
+
+// compileQuery translates a search query into an SQL condition over
+// request_responses.
+func compileQuery(src string) (string, []any, error) {
+	expr, err := query.Parse(src)
+	if err != nil {
+		return "", nil, err
+	}
+	var args []any
+	sql, err := compileExpr(expr, &args)
+	if err != nil {
+		return "", nil, err
+	}
+	return sql, args, nil
+}
+
+func compileExpr(expr query.Expr, args *[]any) (string, error) {
+	switch e := expr.(type) {
+	case *query.Binary:
+		x, err := compileExpr(e.X, args)
+		if err != nil {
+			return "", err
+		}
+		y, err := compileExpr(e.Y, args)
+		if err != nil {
+			return "", err
+		}
+		op := " AND "
+		if e.Op == "||" {
+			op = " OR "
+		}
+		return "(" + x + op + y + ")", nil
+
+	case *query.Not:
+		x, err := compileExpr(e.X, args)
+		if err != nil {
+			return "", err
+		}
+		return "NOT " + x, nil
+
+	case *query.Exists:
+		field, path, err := resolveField(e.Field)
+		if err != nil {
+			return "", err
+		}
+		if path == "" {
+			return "", query.Errorf(e.Field, "exists needs a keyed field like req.header[\"Authorization\"]")
+		}
+		*args = append(*args, path)
+		return "(json_type(" + field.column + ", ?) IS NOT NULL)", nil
+
+	case *query.Compare:
+		return compileCompare(e, args)
+	}
+	return "", query.Errorf(expr, "unsupported expression")
+}
+
+// resolveField returns the field and, for keyed fields, the JSON path of
+// the key.
+func resolveField(f query.Field) (queryField, string, error) {
+	field, ok := queryFields[strings.ToLower(f.Name)]
+	if !ok {
+		return queryField{}, "", query.Errorf(f, "unknown field %q", f.Name)
+	}
+
+	keyed := field.kind == fieldHeaders || field.kind == fieldMap || field.kind == fieldCookies
+	switch {
+	case keyed && !f.HasKey:
+		return queryField{}, "", query.Errorf(f, "%s needs a key, e.g. %s[\"name\"]", f.Name, f.Name)
+	case !keyed && f.HasKey:
+		return queryField{}, "", query.Errorf(f, "%s has no keys", f.Name)
+	case !keyed:
+		return field, "", nil
+	}
+
+	key := f.Key
+	if field.kind == fieldHeaders {
+		key = textproto.CanonicalMIMEHeaderKey(key)
+	}
+	if strings.ContainsAny(key, `"\`) {
+		return queryField{}, "", query.Errorf(f, "key must not contain quotes or backslashes")
+	}
+	return field, `$."` + key + `"`, nil
+}
+
+func compileCompare(c *query.Compare, args *[]any) (string, error) {
+	field, path, err := resolveField(c.Field)
+	if err != nil {
+		return "", err
+	}
+	value := c.Value
+
+	if path != "" {
+		// Keyed fields match if any of their values does.
+		if value.Kind != query.String {
+			return "", query.Errorf(value, "%s values are strings, got %s", c.Field.Name, value.Kind)
+		}
+		*args = append(*args, path)
+		cond, negate := stringCondition("value", c, value.Str, args)
+		sql := "EXISTS (SELECT 1 FROM json_each(" + field.column + ", ?) WHERE " + cond + ")"
+		if negate {
+			sql = "NOT " + sql
+		}
+		return sql, nil
+	}
+
+	switch field.kind {
+	case fieldString:
+		if value.Kind != query.String {
+			return "", query.Errorf(value, "%s is a string, got %s", c.Field.Name, value.Kind)
+		}
+		cond, negate := stringCondition(field.column, c, value.Str, args)
+		if negate {
+			return "NOT (" + cond + ")", nil
+		}
+		return "(" + cond + ")", nil
+
+	case fieldNumber:
+		if value.Kind != query.Number {
+			return "", query.Errorf(value, "%s is a number, got %s", c.Field.Name, value.Kind)
+		}
+		return orderedCondition(field.column, c, value.Num, args)
+
+	case fieldBool:
+		if value.Kind != query.Bool {
+			return "", query.Errorf(value, "%s is a boolean, got %s", c.Field.Name, value.Kind)
+		}
+		if c.Op != "==" && c.Op != "!=" {
+			return "", query.Errorf(c, "%s supports == and != only", c.Field.Name)
+		}
+		return orderedCondition(field.column, c, value.Bool, args)
+
+	case fieldTime:
+		if value.Kind != query.String {
+			return "", query.Errorf(value, "%s is an RFC 3339 time string, got %s", c.Field.Name, value.Kind)
+		}
+		t, err := time.Parse(time.RFC3339, value.Str)
+		if err != nil {
+			return "", query.Errorf(value, "bad time, want RFC 3339 like \"2006-01-02T15:04:05Z\"")
+		}
+		return timeCondition(field.column, c, t.UTC(), args)
+	}
+	return "", query.Errorf(c, "unsupported field %s", c.Field.Name)
+}
+
+// stringCondition compares column with s. Negated operators are returned
+// as their positive form with negate set, so keyed fields mean "no value".
+func stringCondition(column string, c *query.Compare, s string, args *[]any) (string, bool) {
+	*args = append(*args, s)
+	switch c.Op {
+	case "~", "!~":
+		// Case insensitive substring.
+		return "instr(lower(" + column + "), lower(?)) > 0", c.Op == "!~"
+	case "==", "!=":
+		return column + " = ?", c.Op == "!="
+	}
+	return column + " " + sqlOperators[c.Op] + " ?", false
+}
+
+func orderedCondition(column string, c *query.Compare, value any, args *[]any) (string, error) {
+	op, ok := sqlOperators[c.Op]
+	if !ok {
+		return "", query.Errorf(c, "%s is not supported for %s", c.Op, c.Field.Name)
+	}
+	*args = append(*args, value)
+	return "(" + column + " " + op + " ?)", nil
+}
+
+func timeCondition(column string, c *query.Compare, t time.Time, args *[]any) (string, error) {
+	op, ok := sqlOperators[c.Op]
+	if !ok {
+		return "", query.Errorf(c, "%s is not supported for %s", c.Op, c.Field.Name)
+	}
+	*args = append(*args, t)
+	return "(" + timeCompare(column, op) + ")", nil
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/mrdjeb/trueproxy/internal/models"
+	"gorm.io/gorm"
+)
+
+// deleteBatch keeps IN lists under the sqlite variable limit.
+const deleteBatch = 500
+
+// autoVacuumIncremental is PRAGMA auto_vacuum of databases that give pages
+// back with PRAGMA incremental_vacuum.
+const autoVacuumIncremental = 2
+
+// bodyBytesColumn is the stored size of request and response bodies.
+const bodyBytesColumn = `length(CAST(body AS BLOB)) + length(CAST(Response_Body AS BLOB))`
+
+func (r requestsRepo) DeleteRequest(ID uint) error {
+	var count int64
+	if err := r.DB.Model(&models.RequestResponse{}).Where("id = ?", ID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrRequestNotFound
+	}
+	return r.deleteIDs([]uint{ID})
+}
+
+// DeleteRequests removes the requests matching filter, paging fields are
+// ignored. Space is reclaimed by a following Vacuum.
+func (r requestsRepo) DeleteRequests(filter RequestFilter) (int64, error) {
+	query, err := r.filtered(filter)
+	if err != nil {
+		return 0, err
+	}
+	var ids []uint
+	if err := query.Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	if err := r.deleteIDs(ids); err != nil {
+		return 0, err
+	}
+	return int64(len(ids)), nil
+}
+
+// PurgeRequests removes requests beyond any limit of policy, oldest first.
+// Space is reclaimed by a following Vacuum.
+func (r requestsRepo) PurgeRequests(policy RetentionPolicy) (int64, error) {
+	var ids []uint
+	if policy.MaxAge > 0 {
+		cutoff := time.Now().Add(-policy.MaxAge).UTC()
+		var old []uint
+		err := r.DB.Model(&models.RequestResponse{}).Where(timeCompare("created_at", "<"), cutoff).Pluck("id", &old).Error
+		if err != nil {
+			return 0, err
+		}
+		ids = append(ids, old...)
+	}
+	if policy.MaxRows > 0 {
+		var extra []uint
+		err := r.DB.Model(&models.RequestResponse{}).Order("id DESC").Offset(int(policy.MaxRows)).Limit(-1).Pluck("id", &extra).Error
+		if err != nil {
+			return 0, err
+		}
+		ids = append(ids, extra...)
+	}
+	if policy.MaxBodyBytes > 0 {
+		// Newest requests are kept while their bodies fit in the budget.
+		var extra []uint
+		err := r.DB.Raw(`SELECT id FROM (
+			SELECT id, SUM(`+bodyBytesColumn+`) OVER (ORDER BY id DESC) AS total
+			FROM request_responses WHERE deleted_at IS NULL
+		) WHERE total > ?`, policy.MaxBodyBytes).Scan(&extra).Error
+		if err != nil {
+			return 0, err
+		}
+		ids = append(ids, extra...)
+	}
+
+	ids = uniqueIDs(ids)
+	return int64(len(ids)), r.deleteIDs(ids)
+}
+
+// EnableIncrementalVacuum switches db to incremental auto vacuum, so
+// deletes can give space back without rebuilding the database. A database
+// created without it is rebuilt with VACUUM once, migrated reports that.
+func EnableIncrementalVacuum(db *gorm.DB) (migrated bool, err error) {
+	// The pragma is pending on its connection until VACUUM there.
+	err = db.Connection(func(conn *gorm.DB) error {
+		mode, err := autoVacuum(conn)
+		if err != nil || mode == autoVacuumIncremental {
+			return err
+		}
+		if err := conn.Exec("PRAGMA auto_vacuum = INCREMENTAL").Error; err != nil {
+			return err
+		}
+		// Empty databases take the mode at once.
+		if mode, err = autoVacuum(conn); err != nil || mode == autoVacuumIncremental {
+			return err
+		}
+		migrated = true
+		return conn.Exec("VACUUM").Error
+	})
+	return migrated, err
+}
+
+func autoVacuum(db *gorm.DB) (int, error) {
+	var mode int
+	err := db.Raw("PRAGMA auto_vacuum").Scan(&mode).Error
+	return mode, err
+}
+
+// Vacuum returns pages freed by deletes to the file system, the database
+// is expected to be switched by EnableIncrementalVacuum.
+func (r requestsRepo) Vacuum() error {
+	// The pragma frees a page per step, Exec would step it once.
+	rows, err := r.DB.Raw("PRAGMA incremental_vacuum").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
+// deleteIDs hard deletes requests with their frames and search index rows,
+// so their space can be reclaimed.
+func (r requestsRepo) deleteIDs(ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		for start := 0; start < len(ids); start += deleteBatch {
+			batch := ids[start:min(start+deleteBatch, len(ids))]
+
+			if err := tx.Unscoped().Where("request_response_id IN ?", batch).Delete(&models.WebSocketFrame{}).Error; err != nil {
+				return err
+			}
+			if r.searchErr == nil {
+				if err := tx.Exec("DELETE FROM "+searchTable+" WHERE rowid IN ?", batch).Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Unscoped().Delete(&models.RequestResponse{}, batch).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func uniqueIDs(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	unique := ids[:0]
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
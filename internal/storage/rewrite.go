@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"github.com/mrdjeb/trueproxy/internal/models"
+	"gorm.io/gorm"
+)
+
+type rewriteRepo struct {
+	rules ruleRepo[models.RewriteRule]
+}
+
+func NewRewriteRepo(db *gorm.DB) RewriteRepo {
+	return &rewriteRepo{
+		rules: ruleRepo[models.RewriteRule]{DB: db},
+	}
+}
+
+func (r rewriteRepo) CreateRewriteRule(rule *models.RewriteRule) error {
+	return r.rules.create(rule)
+}
+
+func (r rewriteRepo) ReadRewriteRules() ([]models.RewriteRule, error) {
+	return r.rules.read()
+}
+
+func (r rewriteRepo) UpdateRewriteRule(rule *models.RewriteRule) error {
+	return r.rules.update(rule)
+}
+
+func (r rewriteRepo) DeleteRewriteRule(ID uint) error {
+	return r.rules.delete(ID)
+}
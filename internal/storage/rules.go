@@ -0,0 +1,47 @@
+package storage
+
+import "gorm.io/gorm"
+
+// ruleRepo stores rules of model T, rewrite and scope rules are kept alike.
+type ruleRepo[T any] struct {
+	DB *gorm.DB
+}
+
+func (r ruleRepo[T]) create(rule *T) error {
+	return r.DB.Create(rule).Error
+}
+
+func (r ruleRepo[T]) read() ([]T, error) {
+	rules := []T{}
+	if err := r.DB.Order("id").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// update overwrites every field of the rule with its primary key, but the
+// creation time, and reads the rule back.
+func (r ruleRepo[T]) update(rule *T) error {
+	result := r.DB.Model(rule).
+		Select("*").
+		Omit("id", "created_at", "deleted_at").
+		Updates(rule)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRuleNotFound
+	}
+	return r.DB.First(rule).Error
+}
+
+func (r ruleRepo[T]) delete(ID uint) error {
+	result := r.DB.Delete(new(T), ID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRuleNotFound
+	}
+	return nil
+}
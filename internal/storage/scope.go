@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"github.com/mrdjeb/trueproxy/internal/models"
+	"gorm.io/gorm"
+)
+
+type scopeRepo struct {
+	DB    *gorm.DB
+	rules ruleRepo[models.ScopeRule]
+}
+
+func NewScopeRepo(db *gorm.DB) ScopeRepo {
+	return &scopeRepo{
+		DB:    db,
+		rules: ruleRepo[models.ScopeRule]{DB: db},
+	}
+}
+
+func (r scopeRepo) CreateScopeRule(rule *models.ScopeRule) error {
+	return r.rules.create(rule)
+}
+
+func (r scopeRepo) ReadScopeRules() ([]models.ScopeRule, error) {
+	return r.rules.read()
+}
+
+func (r scopeRepo) UpdateScopeRule(rule *models.ScopeRule) error {
+	return r.rules.update(rule)
+}
+
+func (r scopeRepo) DeleteScopeRule(ID uint) error {
+	return r.rules.delete(ID)
+}
+
+func (r scopeRepo) MarkOutOfScope(outOfScope func(*models.RequestResponse) bool) error {
+	var batch []models.RequestResponse
+	result := r.DB.
+		Select("id", "scheme", "host", "path", "Response_Headers", "out_of_scope").
+		FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+			changed := map[bool][]uint{}
+			for i := range batch {
+				if out := outOfScope(&batch[i]); out != batch[i].OutOfScope {
+					changed[out] = append(changed[out], batch[i].ID)
+				}
+			}
+			for out, ids := range changed {
+				err := r.DB.Model(&models.RequestResponse{}).
+					Where("id IN ?", ids).
+					Update("out_of_scope", out).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	return result.Error
+}
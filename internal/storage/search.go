@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+
+	"github.com/mrdjeb/trueproxy/internal/models"
+	"gorm.io/gorm"
+)
+
+// searchTable is the FTS5 index of request_responses, rowid is the request
+// id. It needs sqlite built with the sqlite_fts5 tag.
+const searchTable = "request_search"
+
+// Matches are delimited in snippets with control characters text hardly
+// has, so a literal "<mark>" in a body is not taken for a match. Results
+// carry snippets as HTML: the text is escaped, then delimiters are turned
+// into highlight tags.
+const (
+	matchStart     = "\x02"
+	matchEnd       = "\x03"
+	highlightStart = "<mark>"
+	highlightEnd   = "</mark>"
+	snippetTokens  = 16
+)
+
+var highlighter = strings.NewReplacer(matchStart, highlightStart, matchEnd, highlightEnd)
+
+// searchColumns are the indexed columns in table order, named apart from
+// request_responses ones as sqlite ignores case. searchParts name them in
+// results.
+var (
+	searchColumns = []string{"req_headers", "req_body", "resp_headers", "resp_body"}
+	searchParts   = []string{
+		models.SearchRequestHeaders,
+		models.SearchRequestBody,
+		models.SearchResponseHeaders,
+		models.SearchResponseBody,
+	}
+)
+
+// initSearch creates the FTS5 index and fills it with requests stored
+// before it existed.
+func initSearch(db *gorm.DB) error {
+	err := db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS " + searchTable +
+		" USING fts5(" + strings.Join(searchColumns, ", ") + ", tokenize = 'unicode61')").Error
+	if err != nil {
+		return err
+	}
+
+	var batch []models.RequestResponse
+	return db.Where("id NOT IN (SELECT rowid FROM "+searchTable+")").
+		FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+			for i := range batch {
+				if err := indexRequest(db, &batch[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+}
+
+func indexRequest(db *gorm.DB, req *models.RequestResponse) error {
+	return db.Exec("INSERT INTO "+searchTable+" (rowid, "+strings.Join(searchColumns, ", ")+") VALUES (?, ?, ?, ?, ?)",
+		req.ID,
+		formatHeaders(req.Request.Headers),
+		req.Request.Body,
+		formatHeaders(req.Response.Headers),
+		req.Response.Body,
+	).Error
+}
+
+// formatHeaders writes headers as "Name: value" lines, sorted by name.
+func formatHeaders(headers map[string][]string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		for _, value := range headers[name] {
+			b.WriteString(name)
+			b.WriteString(": ")
+			b.WriteString(value)
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+// searchPhrase quotes text as an FTS5 phrase, a trailing "*" makes its last
+// token a prefix.
+func searchPhrase(text string) string {
+	prefix := strings.HasSuffix(text, "*")
+	text = strings.TrimSuffix(text, "*")
+	phrase := `"` + strings.ReplaceAll(text, `"`, `""`) + `"`
+	if prefix {
+		phrase += "*"
+	}
+	return phrase
+}
+
+type searchRow struct {
+	models.RequestSummary
+	Snippet0 string
+	Snippet1 string
+	Snippet2 string
+	Snippet3 string
+}
+
+func (r requestsRepo) SearchRequests(text string, limit, offset int) ([]models.SearchResult, error) {
+	if r.searchErr != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSearchUnavailable, r.searchErr)
+	}
+	if strings.TrimSpace(strings.TrimSuffix(text, "*")) == "" {
+		return nil, fmt.Errorf("%w: empty search text", ErrBadFilter)
+	}
+
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	columns := append([]string{}, summaryColumns...)
+	var args []any
+	for i := range searchColumns {
+		columns = append(columns, fmt.Sprintf("snippet(%s, %d, ?, ?, '…', %d) AS snippet%d",
+			searchTable, i, snippetTokens, i))
+		args = append(args, matchStart, matchEnd)
+	}
+	args = append(args, searchPhrase(text), limit, offset)
+
+	var rows []searchRow
+	err := r.DB.Raw("SELECT "+strings.Join(columns, ", ")+
+		" FROM "+searchTable+" JOIN request_responses ON request_responses.id = "+searchTable+".rowid"+
+		" WHERE "+searchTable+" MATCH ? AND request_responses.deleted_at IS NULL"+
+		" ORDER BY rank LIMIT ? OFFSET ?",
+		args...,
+	).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]models.SearchResult, 0, len(rows))
+	for _, row := range rows {
+		result := models.SearchResult{RequestSummary: row.RequestSummary}
+		// Snippets of columns without a match carry no highlight.
+		for i, snippet := range []string{row.Snippet0, row.Snippet1, row.Snippet2, row.Snippet3} {
+			if strings.Contains(snippet, matchStart) {
+				result.Matches = append(result.Matches, models.SearchMatch{Part: searchParts[i], Snippet: highlighter.Replace(html.EscapeString(snippet))})
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -1,22 +1,42 @@
 package storage
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/mrdjeb/trueproxy/internal/models"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type requestsRepo struct {
-	DB *gorm.DB
+	DB        *gorm.DB
+	searchErr error // why full-text search is off
 }
 
 func NewRequestsRepo(db *gorm.DB) RequestsRepo {
 	return &requestsRepo{
-		DB: db,
+		DB:        db,
+		searchErr: initSearch(db),
 	}
 }
 
+// CreateRequest stores req with its search index row. On failure nothing
+// is stored and req.ID is left zero.
 func (r requestsRepo) CreateRequest(req *models.RequestResponse) error {
-	r.DB.Create(req)
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(req).Error; err != nil {
+			return err
+		}
+		if r.searchErr != nil {
+			return nil
+		}
+		return indexRequest(tx, req)
+	})
+	if err != nil {
+		req.ID = 0
+		return err
+	}
 	return nil
 }
 
@@ -35,17 +55,183 @@ func (r requestsRepo) ReadRequest(ID uint) (models.RequestResponse, error) {
 	return req, nil
 
 }
-func (r requestsRepo) ReadAllRequest() ([]models.RequestResponse, error) {
-	var reqs []models.RequestResponse
-	result := r.DB.Find(&reqs)
 
+// contentTypeColumn is the first response Content-Type header value.
+const contentTypeColumn = `COALESCE(json_extract(Response_Headers, '$."Content-Type"[0]'), '')`
+
+var summaryColumns = []string{
+	"id",
+	"created_at",
+	"method",
+	"scheme",
+	"host",
+	"path",
+	"Response_StatusCode AS status_code",
+	contentTypeColumn + " AS content_type",
+	"out_of_scope",
+}
+
+var sortColumns = map[string]string{
+	"id":     "id",
+	"time":   "id", // ids grow with time and are indexed
+	"host":   "host",
+	"method": "method",
+	"status": "Response_StatusCode",
+	"path":   "path",
+}
+
+// likeEscaper escapes LIKE wildcards, patterns use ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// timeCompare is a condition comparing time column with a bound UTC time.
+// Times are stored as text, which orders by instant only as long as every
+// one is in UTC, see UTCCreatedAt.
+func timeCompare(column, op string) string {
+	return column + " " + op + " ?"
+}
+
+// utcTimeFormat is the text the sqlite driver stores UTC times as, by
+// strftime, with milliseconds.
+const utcTimeFormat = "%Y-%m-%d %H:%M:%f+00:00"
+
+// UTCCreatedAt rewrites created_at of requests stored with a zone offset
+// into UTC and indexes it, so time filters and the age purge compare text
+// on the index. New requests are expected to be stored in UTC, by gorm
+// NowFunc.
+func UTCCreatedAt(db *gorm.DB) error {
+	err := db.Exec("UPDATE request_responses SET created_at = strftime(?, created_at) WHERE created_at NOT LIKE '%+00:00'", utcTimeFormat).Error
+	if err != nil {
+		return err
+	}
+	return db.Exec("CREATE INDEX IF NOT EXISTS idx_request_responses_created_at ON request_responses(created_at)").Error
+}
+
+// filtered selects the requests matching filter, without paging.
+func (r requestsRepo) filtered(filter RequestFilter) (*gorm.DB, error) {
+	query := r.DB.Model(&models.RequestResponse{})
+
+	if filter.InScope {
+		query = query.Where("out_of_scope = ?", false)
+	}
+	if filter.SNI != "" {
+		query = query.Where("client_sni = ?", filter.SNI)
+	}
+	if filter.JA3 != "" {
+		query = query.Where("client_ja3_hash = ?", filter.JA3)
+	}
+	if filter.JA4 != "" {
+		query = query.Where("client_ja4 = ?", filter.JA4)
+	}
+	if filter.Host != "" {
+		pattern := strings.ReplaceAll(likeEscaper.Replace(filter.Host), "*", "%")
+		query = query.Where(`(host LIKE ? ESCAPE '\' OR host LIKE ? ESCAPE '\')`, pattern, pattern+":%")
+	}
+	if filter.Method != "" {
+		query = query.Where("method = ?", strings.ToUpper(filter.Method))
+	}
+	if filter.StatusMin != 0 {
+		query = query.Where("Response_StatusCode >= ?", filter.StatusMin)
+	}
+	if filter.StatusMax != 0 {
+		query = query.Where("Response_StatusCode <= ?", filter.StatusMax)
+	}
+	if filter.Path != "" {
+		query = query.Where("instr(path, ?) > 0", filter.Path)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where(timeCompare("created_at", ">="), filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where(timeCompare("created_at", "<"), filter.Until.UTC())
+	}
+	if filter.ContentType != "" {
+		query = query.Where(contentTypeColumn+` LIKE ? ESCAPE '\'`, likeEscaper.Replace(filter.ContentType)+"%")
+	}
+
+	if filter.Query != "" {
+		cond, args, err := compileQuery(filter.Query)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrBadFilter, err)
+		}
+		query = query.Where(cond, args...)
+	}
+	return query, nil
+}
+
+func (r requestsRepo) ListRequests(filter RequestFilter) ([]models.RequestSummary, error) {
+	query, err := r.filtered(filter)
+	if err != nil {
+		return nil, err
+	}
+	query = query.Select(summaryColumns)
+
+	sort := filter.Sort
+	if sort == "" {
+		sort = "id"
+	}
+	desc := strings.HasPrefix(sort, "-")
+	column, ok := sortColumns[strings.TrimPrefix(sort, "-")]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown sort %q", ErrBadFilter, filter.Sort)
+	}
+
+	if filter.Cursor != 0 {
+		if column != "id" {
+			return nil, fmt.Errorf("%w: cursor needs id or time sort", ErrBadFilter)
+		}
+		if desc {
+			query = query.Where("id < ?", filter.Cursor)
+		} else {
+			query = query.Where("id > ?", filter.Cursor)
+		}
+	}
+
+	// Ties are broken by id to keep pages stable.
+	query = query.Order(clause.OrderByColumn{Column: clause.Column{Name: column}, Desc: desc})
+	if column != "id" {
+		query = query.Order(clause.OrderByColumn{Column: clause.Column{Name: "id"}, Desc: desc})
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	reqs := []models.RequestSummary{}
+	result := query.Limit(limit).Offset(filter.Offset).Scan(&reqs)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 
-	if result.RowsAffected == 0 {
-		return nil, ErrRequestNotFound
+	return reqs, nil
+}
+
+func (r requestsRepo) CreateFrame(frame *models.WebSocketFrame) error {
+	return r.DB.Create(frame).Error
+}
+
+func (r requestsRepo) ReadFrames(requestID uint) ([]models.WebSocketFrame, error) {
+	frames := []models.WebSocketFrame{}
+	result := r.DB.Where("request_response_id = ?", requestID).Order("id").Find(&frames)
+
+	if result.Error != nil {
+		return nil, result.Error
 	}
 
-	return reqs, nil
+	return frames, nil
+}
+
+func (r requestsRepo) CreateTunnel(tunnel *models.Tunnel) error {
+	return r.DB.Create(tunnel).Error
+}
+
+func (r requestsRepo) ReadTunnels() ([]models.Tunnel, error) {
+	tunnels := []models.Tunnel{}
+	if err := r.DB.Order("id").Find(&tunnels).Error; err != nil {
+		return nil, err
+	}
+	return tunnels, nil
 }
@@ -0,0 +1,177 @@
+package writequeue
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mrdjeb/trueproxy/internal/config"
+	"github.com/mrdjeb/trueproxy/internal/logger/sl"
+)
+
+// Stats are counters of a Queue since start.
+type Stats struct {
+	Capacity  int    `json:"capacity"`
+	Queued    int    `json:"queued"`     // waiting writes
+	MaxQueued int64  `json:"max_queued"` // highest Queued seen
+	Enqueued  uint64 `json:"enqueued"`
+	Written   uint64 `json:"written"`
+	Retries   uint64 `json:"retries"`
+	Failed    uint64 `json:"failed"`  // lost after all retries
+	Dropped   uint64 `json:"dropped"` // not written: the queue was full or closed, or the write skipped itself
+}
+
+// ErrSkip is returned by a write that has nothing to store any more, e.g.
+// a frame of a request that failed to store. It is counted as dropped.
+var ErrSkip = errors.New("write skipped")
+
+type job struct {
+	kind  string
+	write func() error
+}
+
+// Queue runs captured traffic writes on a single goroutine in the order
+// they were enqueued, so proxied connections never wait for storage.
+// A write may rely on the ones enqueued before it, e.g. a WebSocket frame
+// reads the ID of its request record when it runs.
+type Queue struct {
+	log        *slog.Logger
+	jobs       chan job
+	retries    int
+	retryDelay time.Duration
+	stop       chan struct{}
+	done       chan struct{}
+
+	mu     sync.Mutex // orders Enqueue with Close
+	closed bool
+
+	maxQueued atomic.Int64
+	enqueued  atomic.Uint64
+	written   atomic.Uint64
+	retried   atomic.Uint64
+	failed    atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+func New(log *slog.Logger, cfg config.WriteQueue) *Queue {
+	q := &Queue{
+		log:        log.With(slog.String("op", "writequeue.Queue")),
+		jobs:       make(chan job, cfg.Size),
+		retries:    cfg.Retries,
+		retryDelay: cfg.RetryDelay,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Enqueue adds a write of kind, e.g. "request", without blocking. It
+// returns false and counts the write as dropped if the queue is full or
+// closed.
+func (q *Queue) Enqueue(kind string, write func() error) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		q.dropped.Add(1)
+		return false
+	}
+	select {
+	case q.jobs <- job{kind: kind, write: write}:
+	default:
+		q.dropped.Add(1)
+		q.log.Debug("write queue is full, dropped", slog.String("kind", kind))
+		return false
+	}
+
+	q.enqueued.Add(1)
+	queued := int64(len(q.jobs))
+	for {
+		prev := q.maxQueued.Load()
+		if queued <= prev || q.maxQueued.CompareAndSwap(prev, queued) {
+			break
+		}
+	}
+	return true
+}
+
+func (q *Queue) Stats() Stats {
+	return Stats{
+		Capacity:  cap(q.jobs),
+		Queued:    len(q.jobs),
+		MaxQueued: q.maxQueued.Load(),
+		Enqueued:  q.enqueued.Load(),
+		Written:   q.written.Load(),
+		Retries:   q.retried.Load(),
+		Failed:    q.failed.Load(),
+		Dropped:   q.dropped.Load(),
+	}
+}
+
+// Close stops accepting writes and waits until queued ones are done or ctx
+// expires.
+func (q *Queue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.stop)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *Queue) run() {
+	defer close(q.done)
+	for {
+		select {
+		case j := <-q.jobs:
+			q.do(j)
+		case <-q.stop:
+			// Writes enqueued before Close are still done.
+			for {
+				select {
+				case j := <-q.jobs:
+					q.do(j)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// do runs j, retrying with doubling delay.
+func (q *Queue) do(j job) {
+	delay := q.retryDelay
+	for attempt := 0; ; attempt++ {
+		err := j.write()
+		if err == nil {
+			q.written.Add(1)
+			return
+		}
+		if errors.Is(err, ErrSkip) {
+			q.dropped.Add(1)
+			q.log.Debug("write skipped", slog.String("kind", j.kind))
+			return
+		}
+		if attempt >= q.retries {
+			q.failed.Add(1)
+			q.log.Error("failed to write", slog.String("kind", j.kind), sl.Err(err))
+			return
+		}
+		q.retried.Add(1)
+		q.log.Warn("write failed, retrying", slog.String("kind", j.kind), slog.Int("attempt", attempt+1), sl.Err(err))
+		time.Sleep(delay)
+		delay *= 2
+	}
+}